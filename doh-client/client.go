@@ -25,20 +25,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ProfitLabs/quic-dns/json-dns"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/h2quic"
 	"github.com/miekg/dns"
 	"golang.org/x/net/http2"
 )
 
+// Upstreams with this scheme are queried over QUIC instead of HTTP/2
+const quicScheme = "quic://"
+
+// How long to use HTTP/2 for a host after its QUIC handshake failed
+const quicRetryInterval = 5 * time.Minute
+
 type Client struct {
 	conf                 *config
 	bootstrap            []string
@@ -50,6 +62,13 @@ type Client struct {
 	httpTransport        *http.Transport
 	httpClient           *http.Client
 	httpClientLastCreate time.Time
+	// QUIC transports by upstream host, replaced after failed handshakes
+	// because h2quic never dials a host again
+	quicTransports map[string]*h2quic.RoundTripper
+	// dialQUIC, replaced in tests
+	quicDial      func(network, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.Session, error)
+	quicBrokenMux sync.Mutex
+	quicBroken    map[string]time.Time
 }
 
 type DNSRequest struct {
@@ -64,7 +83,8 @@ type DNSRequest struct {
 
 func NewClient(conf *config) (c *Client, err error) {
 	c = &Client{
-		conf: conf,
+		conf:       conf,
+		quicBroken: map[string]time.Time{},
 	}
 
 	udpHandler := dns.HandlerFunc(c.udpHandlerFunc)
@@ -115,6 +135,7 @@ func NewClient(conf *config) (c *Client, err error) {
 			return nil, err
 		}
 	}
+	c.quicDial = c.dialQUIC
 	c.httpClientMux = new(sync.RWMutex)
 	err = c.newHTTPClient()
 	if err != nil {
@@ -164,10 +185,172 @@ func (c *Client) newHTTPClient() error {
 		Transport: c.httpTransport,
 		Jar:       c.cookieJar,
 	}
+
+	for _, transport := range c.quicTransports {
+		transport.Close()
+	}
+	c.quicTransports = map[string]*h2quic.RoundTripper{}
 	c.httpClientLastCreate = time.Now()
 	return nil
 }
 
+// quicClient returns the client for QUIC requests to host. Its transport
+// is passed to resetQUIC after a failed handshake.
+func (c *Client) quicClient(host string) (*http.Client, *h2quic.RoundTripper) {
+	c.httpClientMux.Lock()
+	defer c.httpClientMux.Unlock()
+	transport := c.quicTransports[host]
+	if transport == nil {
+		transport = &h2quic.RoundTripper{
+			QuicConfig: &quic.Config{
+				HandshakeTimeout: c.quicHandshakeTimeout(),
+			},
+			Dial: c.quicDial,
+		}
+		c.quicTransports[host] = transport
+	}
+	return &http.Client{
+		Transport: transport,
+		Jar:       c.cookieJar,
+		Timeout:   time.Duration(c.conf.Timeout) * time.Second,
+	}, transport
+}
+
+// resetQUIC drops the transport of host, so the next QUIC request dials
+// again instead of getting the old handshake error
+func (c *Client) resetQUIC(host string, transport *h2quic.RoundTripper) {
+	c.httpClientMux.Lock()
+	if c.quicTransports[host] == transport {
+		delete(c.quicTransports, host)
+	}
+	c.httpClientMux.Unlock()
+	transport.Close()
+}
+
+// quicDialError is a failure to open a QUIC session, which makes the
+// client fall back to HTTP/2
+type quicDialError struct {
+	err error
+}
+
+func (e *quicDialError) Error() string {
+	return e.err.Error()
+}
+
+// Resolve the upstream host with the bootstrap resolver and open a QUIC session
+func (c *Client) dialQUIC(network, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.Session, error) {
+	session, err := c.dialQUICSession(addr, tlsConfig, quicConfig)
+	if err != nil {
+		return nil, &quicDialError{err}
+	}
+	return session, nil
+}
+
+func (c *Client) dialQUICSession(addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.Session, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.quicHandshakeTimeout())
+	defer cancel()
+	ipAddrs, err := c.bootstrapResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = errors.New("no suitable address found for " + host)
+	for _, ipAddr := range ipAddrs {
+		if c.conf.NoIPv6 && ipAddr.IP.To4() == nil {
+			continue
+		}
+		var udpConn *net.UDPConn
+		udpConn, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		var session quic.Session
+		session, err = quic.DialContext(ctx, udpConn, &net.UDPAddr{IP: ipAddr.IP, Port: port, Zone: ipAddr.Zone}, addr, tlsConfig, quicConfig)
+		if err == nil {
+			// quic-go doesn't close sockets passed to it
+			go func() {
+				<-session.Context().Done()
+				udpConn.Close()
+			}()
+			return session, nil
+		}
+		udpConn.Close()
+	}
+	return nil, err
+}
+
+// A failed handshake has to be noticed before the request times out, so
+// there is time left to fall back to HTTP/2
+func (c *Client) quicHandshakeTimeout() time.Duration {
+	return time.Duration(c.conf.Timeout) * time.Second / 2
+}
+
+// Strip the quic:// scheme from the upstream address.
+// The returned URL is always an https:// one.
+func parseUpstreamURL(upstream string) (upstreamURL string, useQUIC bool) {
+	if strings.HasPrefix(upstream, quicScheme) {
+		return "https://" + strings.TrimPrefix(upstream, quicScheme), true
+	}
+	return upstream, false
+}
+
+// Send the request over QUIC if requested, falling back to HTTP/2 when
+// the QUIC handshake with the upstream fails.
+func (c *Client) doHTTPRequest(req *http.Request, useQUIC bool) (*http.Response, error) {
+	if useQUIC && c.isQUICUsable(req.URL.Host) {
+		client, transport := c.quicClient(req.URL.Host)
+		resp, err := client.Do(req)
+		if err == nil || !isQUICDialError(err) {
+			return resp, err
+		}
+		log.Printf("QUIC request to %s failed, falling back to HTTP/2: %v", req.URL.Host, err)
+		c.resetQUIC(req.URL.Host, transport)
+		c.quicBrokenMux.Lock()
+		c.quicBroken[req.URL.Host] = time.Now()
+		c.quicBrokenMux.Unlock()
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.httpClientMux.RLock()
+	resp, err := c.httpClient.Do(req)
+	c.httpClientMux.RUnlock()
+	return resp, err
+}
+
+func isQUICDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	_, ok := err.(*quicDialError)
+	return ok
+}
+
+func (c *Client) isQUICUsable(host string) bool {
+	c.quicBrokenMux.Lock()
+	defer c.quicBrokenMux.Unlock()
+	brokenSince, ok := c.quicBroken[host]
+	if !ok {
+		return true
+	}
+	if time.Since(brokenSince) < quicRetryInterval {
+		return false
+	}
+	delete(c.quicBroken, host)
+	return true
+}
+
 func (c *Client) Start() error {
 	results := make(chan error, len(c.udpServers)+len(c.tcpServers))
 	for _, srv := range append(c.udpServers, c.tcpServers...) {
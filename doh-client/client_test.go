@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/h2quic"
+)
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// A host whose QUIC handshake failed is dialed again after
+// quicRetryInterval instead of failing with the old handshake error
+func TestQUICRedialAfterHandshakeFailure(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &h2quic.Server{Server: &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}},
+	}}
+	go server.Serve(conn)
+	defer server.Close()
+
+	c := &Client{
+		conf:          &config{Timeout: 5},
+		httpClientMux: new(sync.RWMutex),
+		quicBroken:    map[string]time.Time{},
+	}
+	if err := c.newHTTPClient(); err != nil {
+		t.Fatal(err)
+	}
+	dials := 0
+	c.quicDial = func(network, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.Session, error) {
+		dials++
+		if dials == 1 {
+			return nil, &quicDialError{errors.New("handshake failed")}
+		}
+		return quic.DialAddr(addr, &tls.Config{InsecureSkipVerify: true}, quicConfig)
+	}
+
+	host := conn.LocalAddr().String()
+	request := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", "https://"+host+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.doHTTPRequest(req, true)
+	}
+
+	// Nothing listens on TCP, so the HTTP/2 fallback fails too
+	if _, err := request(); err == nil {
+		t.Fatal("request without a QUIC session succeeded")
+	}
+	if c.isQUICUsable(host) {
+		t.Fatal("QUIC is used right after a failed handshake")
+	}
+	c.quicBroken[host] = time.Now().Add(-quicRetryInterval)
+
+	resp, err := request()
+	if err != nil {
+		t.Fatalf("request after quicRetryInterval failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("got body %q", body)
+	}
+	if dials != 2 {
+		t.Errorf("dialed %d times, want 2", dials)
+	}
+}
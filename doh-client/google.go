@@ -65,7 +65,8 @@ func (c *Client) generateRequestGoogle(w dns.ResponseWriter, r *dns.Msg, isTCP b
 
 	numServers := len(c.conf.UpstreamGoogle)
 	upstream := c.conf.UpstreamGoogle[rand.Intn(numServers)]
-	requestURL := fmt.Sprintf("%s?ct=application/dns-json&name=%s&type=%s", upstream, url.QueryEscape(questionName), url.QueryEscape(questionType))
+	upstreamURL, useQUIC := parseUpstreamURL(upstream)
+	requestURL := fmt.Sprintf("%s?ct=application/dns-json&name=%s&type=%s", upstreamURL, url.QueryEscape(questionName), url.QueryEscape(questionType))
 
 	if r.CheckingDisabled {
 		requestURL += "&cd=1"
@@ -92,9 +93,7 @@ func (c *Client) generateRequestGoogle(w dns.ResponseWriter, r *dns.Msg, isTCP b
 	}
 	req.Header.Set("Accept", "application/json, application/dns-message, application/dns-udpwireformat")
 	req.Header.Set("User-Agent", USER_AGENT)
-	c.httpClientMux.RLock()
-	resp, err := c.httpClient.Do(req)
-	c.httpClientMux.RUnlock()
+	resp, err := c.doHTTPRequest(req, useQUIC)
 	if err != nil {
 		log.Println(err)
 		reply.Rcode = dns.RcodeServerFailure
@@ -126,7 +126,8 @@ func (c *Client) generateRequestIETF(w dns.ResponseWriter, r *dns.Msg, isTCP boo
 
 	numServers := len(c.conf.UpstreamIETF)
 	upstream := c.conf.UpstreamIETF[rand.Intn(numServers)]
-	requestURL := fmt.Sprintf("%s?ct=application/dns-message&dns=%s", upstream, requestBase64)
+	upstreamURL, useQUIC := parseUpstreamURL(upstream)
+	requestURL := fmt.Sprintf("%s?ct=application/dns-message&dns=%s", upstreamURL, requestBase64)
 
 	var req *http.Request
 	if len(requestURL) < 2048 {
@@ -139,7 +140,7 @@ func (c *Client) generateRequestIETF(w dns.ResponseWriter, r *dns.Msg, isTCP boo
 			}
 		}
 	} else {
-		req, err = http.NewRequest("POST", upstream, bytes.NewReader(requestBinary))
+		req, err = http.NewRequest("POST", upstreamURL, bytes.NewReader(requestBinary))
 		if err != nil {
 			// Do not respond, silently fail to prevent caching of SERVFAIL
 			log.Println(err)
@@ -151,9 +152,7 @@ func (c *Client) generateRequestIETF(w dns.ResponseWriter, r *dns.Msg, isTCP boo
 	}
 	req.Header.Set("Accept", "application/dns-message, application/dns-udpwireformat, application/json")
 	req.Header.Set("User-Agent", USER_AGENT)
-	c.httpClientMux.RLock()
-	resp, err := c.httpClient.Do(req)
-	c.httpClientMux.RUnlock()
+	resp, err := c.doHTTPRequest(req, useQUIC)
 	if err != nil {
 		log.Println(err)
 		reply.Rcode = dns.RcodeServerFailure
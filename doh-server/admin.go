@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Request body of POST /lists/entries
+type overlayRequest struct {
+	Rule    string `json:"rule"`
+	Action  string `json:"action"`
+	Comment string `json:"comment"`
+	// Lifetime of the entry in seconds, 0 keeps it until it's removed
+	ExpiresIn uint `json:"expires_in"`
+}
+
+// Response of GET /lists/explain
+type explanation struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile"`
+	Blocked bool   `json:"blocked"`
+	// Kind of the list which decided, empty if no list matched
+	List     string `json:"list"`
+	ListName string `json:"list_name,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+}
+
+// handleAdminAPI registers the list entry API, which needs a token from
+// admin_tokens
+func (s *Server) handleAdminAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/lists/entries", s.adminAuth(s.serveOverlayEntries))
+	mux.HandleFunc("/lists/explain", s.adminAuth(s.serveExplain))
+}
+
+func (s *Server) adminAuth(handler func(w http.ResponseWriter, r *http.Request, admin string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := s.adminTokens.authenticate(r, "")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		handler(w, r, admin)
+	}
+}
+
+func (s *Server) serveOverlayEntries(w http.ResponseWriter, r *http.Request, admin string) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, 200, s.overlay.lists().entries)
+
+	case "POST":
+		var request overlayRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), 400)
+			return
+		}
+		e := &overlayEntry{
+			Rule:    strings.TrimSpace(request.Rule),
+			Action:  request.Action,
+			Comment: request.Comment,
+			AddedBy: admin,
+			Added:   time.Now().UTC(),
+		}
+		if request.ExpiresIn != 0 {
+			expires := e.Added.Add(time.Duration(request.ExpiresIn) * time.Second)
+			e.Expires = &expires
+		}
+		if err := s.overlay.checkEntry(e); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if err := s.overlay.add(e); err != nil {
+			if _, ok := err.(*regexpLimitError); ok {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			log.Printf("[Warning] Unable to save %s: %v", s.overlay.path, err)
+			http.Error(w, "Unable to save the entry", 500)
+			return
+		}
+		log.Printf("Admin %s added %s entry %q", admin, e.Action, e.Rule)
+		writeJSON(w, 201, e)
+
+	case "DELETE":
+		rule, action := r.FormValue("rule"), r.FormValue("action")
+		removed, err := s.overlay.remove(rule, action)
+		if err != nil {
+			log.Printf("[Warning] Unable to save %s: %v", s.overlay.path, err)
+			http.Error(w, "Unable to remove the entry", 500)
+			return
+		}
+		if removed == 0 {
+			http.Error(w, "No such entry", 404)
+			return
+		}
+		log.Printf("Admin %s removed %q", admin, rule)
+		w.WriteHeader(204)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// serveExplain tells how a name would be filtered for a profile and the
+// categories of the "categories" parameter
+func (s *Server) serveExplain(w http.ResponseWriter, r *http.Request, admin string) {
+	name := r.FormValue("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		http.Error(w, "Invalid name", 400)
+		return
+	}
+	profileID := r.FormValue("profile")
+	if profileID == defaultProfileName {
+		profileID = ""
+	}
+	p := s.state().profiles[profileID]
+	if p == nil {
+		http.Error(w, "Unknown profile", 404)
+		return
+	}
+	categories, err := s.parseFilterCategories(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	fqdn := strings.ToLower(dns.Fqdn(name))
+	m := s.matchLists(fqdn, p, categories|p.categories)
+	result := explanation{
+		Name:     fqdn,
+		Profile:  p.id,
+		Blocked:  m.blocked,
+		List:     m.list,
+		ListName: m.name,
+	}
+	if result.Profile == "" {
+		result.Profile = defaultProfileName
+	}
+	if m.domains != nil {
+		result.Rule, _ = m.domains.Rule(fqdn)
+	}
+	writeJSON(w, 200, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the token file is checked for changes
+const authTokensCheckInterval = 10 * time.Second
+
+// authenticator accepts requests carrying a bearer token from the token
+// file or a client certificate verified against the client CA
+type authenticator struct {
+	tokensPath string
+
+	mu      sync.RWMutex
+	tokens  map[[sha256.Size]byte]string
+	modTime time.Time
+}
+
+func newAuthenticator(tokensPath string) (*authenticator, error) {
+	a := &authenticator{tokensPath: tokensPath}
+	if tokensPath == "" {
+		return a, nil
+	}
+	if err := a.reloadTokens(); err != nil {
+		return nil, err
+	}
+	go a.watchTokens()
+	return a, nil
+}
+
+// reloadTokens reads the token file if it was modified. Every line holds
+// a token optionally followed by a client name, '#' starts a comment.
+func (a *authenticator) reloadTokens() error {
+	info, err := os.Stat(a.tokensPath)
+	if err != nil {
+		return err
+	}
+	a.mu.RLock()
+	modified := !info.ModTime().Equal(a.modTime)
+	a.mu.RUnlock()
+	if !modified {
+		return nil
+	}
+
+	file, err := os.Open(a.tokensPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tokens := map[[sha256.Size]byte]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if hash := strings.IndexByte(line, '#'); hash >= 0 {
+			line = line[:hash]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		sum := sha256.Sum256([]byte(fields[0]))
+		// Clients without a name are told apart by their token hash
+		name := fmt.Sprintf("%x", sum[:4])
+		if len(fields) > 1 {
+			name = fields[1]
+		}
+		tokens[sum] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.tokens = tokens
+	a.modTime = info.ModTime()
+	a.mu.Unlock()
+	log.Printf("Auth tokens: %d", len(tokens))
+	return nil
+}
+
+func (a *authenticator) watchTokens() {
+	for range time.Tick(authTokensCheckInterval) {
+		if err := a.reloadTokens(); err != nil {
+			log.Printf("[Warning] Unable to reload auth tokens, keeping the old ones: %v", err)
+		}
+	}
+}
+
+// checkToken returns the client name of a known token.
+// Tokens are compared by their hashes, so lookups don't leak them
+// through timing.
+func (a *authenticator) checkToken(token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	name, ok := a.tokens[sha256.Sum256([]byte(token))]
+	return name, ok
+}
+
+// authenticate returns the name of the client, or false if the request
+// has neither a valid token nor a verified client certificate.
+// A token in the Authorization header takes precedence over pathToken.
+func (a *authenticator) authenticate(r *http.Request, pathToken string) (string, bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if !strings.HasPrefix(header, "Bearer ") {
+			return "", false
+		}
+		return a.checkToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+	}
+	if pathToken != "" {
+		return a.checkToken(pathToken)
+	}
+	// Client certificates are only available over TCP, loadConfig
+	// doesn't allow them with QUIC
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	return "", false
+}
+
+func loadClientCA(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates are found in %s", path)
+	}
+	return pool, nil
+}
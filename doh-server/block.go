@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Responses to queries for restricted names
+const (
+	BlockModeNXDomain = "nxdomain"
+	BlockModeRefused  = "refused"
+	BlockModeNoData   = "nodata"
+	BlockModeSinkhole = "sinkhole"
+)
+
+func checkBlockMode(mode string) error {
+	switch mode {
+	case BlockModeNXDomain, BlockModeRefused, BlockModeNoData, BlockModeSinkhole:
+		return nil
+	}
+	return fmt.Errorf("unknown block_mode %q", mode)
+}
+
+// blockResponse synthesizes the answer for a restricted question
+func (s *Server) blockResponse(request *dns.Msg, mode string) *dns.Msg {
+	msg := newReply(request)
+	question := &request.Question[0]
+	conf := s.state().conf
+	ttl := conf.BlockTTL
+	switch mode {
+	case BlockModeRefused:
+		msg.Rcode = dns.RcodeRefused
+	case BlockModeNXDomain:
+		msg.Rcode = dns.RcodeNameError
+		msg.Ns = []dns.RR{blockSOA(question.Name, ttl)}
+	case BlockModeSinkhole:
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		if question.Qtype == dns.TypeA {
+			msg.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.ParseIP(conf.SinkholeIPv4)}}
+		} else if question.Qtype == dns.TypeAAAA {
+			msg.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(conf.SinkholeIPv6)}}
+		} else {
+			msg.Ns = []dns.RR{blockSOA(question.Name, ttl)}
+		}
+	default:
+		msg.Ns = []dns.RR{blockSOA(question.Name, ttl)}
+	}
+	return msg
+}
+
+// newReply returns an empty response synthesized by the server
+func newReply(request *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(request)
+	msg.RecursionAvailable = true
+	if opt := request.IsEdns0(); opt != nil {
+		msg.SetEdns0(dns.DefaultMsgSize, opt.Do())
+	}
+	return msg
+}
+
+// blockSOA makes negative answers for restricted names cacheable
+// by clients for ttl seconds, see RFC 2308.
+func blockSOA(name string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "blocked.invalid.",
+		Mbox:    "hostmaster.blocked.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  ttl,
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+)
+
+// Popular responses are prefetched when less than this part of their
+// TTL is left
+const cachePrefetchRatio = 0.1
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+	// Requests answered from the entry
+	hits uint32
+	// Set once a prefetch is started
+	prefetching uint32
+}
+
+type cacheConfig struct {
+	size   int
+	minTTL uint32
+	maxTTL uint32
+	// Expired responses are kept for staleTTL and answered with
+	// staleAnswerTTL when upstreams fail (RFC 8767), 0 disables it
+	staleTTL       time.Duration
+	staleAnswerTTL uint32
+	// Entries with this many hits are prefetched, 0 disables it
+	prefetchHits uint32
+}
+
+func newCacheConfig(conf *config) cacheConfig {
+	return cacheConfig{
+		size:           conf.CacheSize,
+		minTTL:         conf.CacheMinTTL,
+		maxTTL:         conf.CacheMaxTTL,
+		staleTTL:       time.Duration(conf.CacheStaleTTL) * time.Second,
+		staleAnswerTTL: conf.CacheStaleAnswerTTL,
+		prefetchHits:   conf.CachePrefetch,
+	}
+}
+
+// ResponseCache keeps upstream responses until their TTL expires.
+// Responses are stored unfiltered, so they can be shared between
+// requests with different filter categories.
+type ResponseCache struct {
+	conf    cacheConfig
+	entries *lru.Cache
+}
+
+func NewResponseCache(conf cacheConfig) (*ResponseCache, error) {
+	entries, err := lru.New(conf.size)
+	if err != nil {
+		return nil, err
+	}
+	return &ResponseCache{
+		conf:    conf,
+		entries: entries,
+	}, nil
+}
+
+// Get returns a copy of the cached response for the request with TTLs
+// decremented by the time spent in the cache, or nil on a miss.
+// Prefetch is true for the first request which finds a popular entry
+// about to expire.
+func (c *ResponseCache) Get(partition string, request *dns.Msg) (response *dns.Msg, prefetch bool) {
+	entry := c.find(partition, request)
+	now := time.Now()
+	if entry == nil || now.After(entry.expires) {
+		return nil, false
+	}
+
+	hits := atomic.AddUint32(&entry.hits, 1)
+	if c.conf.prefetchHits != 0 && hits >= c.conf.prefetchHits {
+		left := entry.expires.Sub(now)
+		if float64(left) < cachePrefetchRatio*float64(entry.expires.Sub(entry.stored)) {
+			prefetch = atomic.CompareAndSwapUint32(&entry.prefetching, 0, 1)
+		}
+	}
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	return entry.response(request, func(ttl uint32) uint32 {
+		if ttl > elapsed {
+			return ttl - elapsed
+		}
+		return 0
+	}), prefetch
+}
+
+// GetStale returns a copy of an expired response within the stale
+// window with every TTL set to the stale answer TTL, or nil.
+func (c *ResponseCache) GetStale(partition string, request *dns.Msg) *dns.Msg {
+	if c.conf.staleTTL == 0 {
+		return nil
+	}
+	entry := c.find(partition, request)
+	if entry == nil {
+		return nil
+	}
+	return entry.response(request, func(uint32) uint32 {
+		return c.conf.staleAnswerTTL
+	})
+}
+
+func (c *ResponseCache) find(partition string, request *dns.Msg) *cacheEntry {
+	key, globalKey, ok := cacheKeys(partition, request)
+	if !ok {
+		return nil
+	}
+	entry := c.lookup(key)
+	if entry == nil && globalKey != key {
+		entry = c.lookup(globalKey)
+	}
+	return entry
+}
+
+// lookup returns the entry of the key, even if it is stale
+func (c *ResponseCache) lookup(key string) *cacheEntry {
+	value, ok := c.entries.Get(key)
+	if !ok {
+		return nil
+	}
+	entry := value.(*cacheEntry)
+	if time.Now().After(entry.expires.Add(c.conf.staleTTL)) {
+		c.entries.Remove(key)
+		return nil
+	}
+	return entry
+}
+
+func (entry *cacheEntry) response(request *dns.Msg, ttl func(uint32) uint32) *dns.Msg {
+	msg := entry.msg.Copy()
+	msg.Id = request.Id
+	matchSubnet(msg, request)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			hdr.Ttl = ttl(hdr.Ttl)
+		}
+	}
+	return msg
+}
+
+// Store saves a copy of the response. Only successful answers and
+// NXDOMAIN/NODATA responses carrying an SOA record are cached.
+func (c *ResponseCache) Store(partition string, request, response *dns.Msg) {
+	if response == nil || response.Truncated {
+		return
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return
+	}
+	key, globalKey, ok := cacheKeys(partition, request)
+	if !ok {
+		return
+	}
+	if responseScope(response) <= 0 {
+		// The answer does not depend on the client subnet
+		key = globalKey
+	}
+
+	ttl, ok := c.responseTTL(response)
+	if !ok {
+		return
+	}
+
+	msg := response.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			hdr.Ttl = c.clampTTL(hdr.Ttl)
+			if hdr.Rrtype == dns.TypeSOA && len(msg.Answer) == 0 && hdr.Ttl > ttl {
+				hdr.Ttl = ttl
+			}
+		}
+	}
+
+	now := time.Now()
+	c.entries.Add(key, &cacheEntry{
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+func (c *ResponseCache) responseTTL(response *dns.Msg) (uint32, bool) {
+	if response.Rcode == dns.RcodeSuccess && len(response.Answer) != 0 {
+		ttl, found := uint32(0), false
+		for _, section := range [][]dns.RR{response.Answer, response.Ns} {
+			for _, rr := range section {
+				if !found || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+					found = true
+				}
+			}
+		}
+		return c.clampTTL(ttl), found
+	}
+
+	// Negative caching according to RFC 2308
+	for _, rr := range response.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return c.clampTTL(ttl), true
+		}
+	}
+	return 0, false
+}
+
+func (c *ResponseCache) clampTTL(ttl uint32) uint32 {
+	if ttl < c.conf.minTTL {
+		ttl = c.conf.minTTL
+	}
+	if c.conf.maxTTL != 0 && ttl > c.conf.maxTTL {
+		ttl = c.conf.maxTTL
+	}
+	return ttl
+}
+
+// cacheKeys returns the key for the exact client subnet and the key
+// shared by all clients for answers with ECS scope 0. Answers are only
+// shared within a partition.
+func cacheKeys(partition string, msg *dns.Msg) (key string, globalKey string, ok bool) {
+	if len(msg.Question) != 1 {
+		return "", "", false
+	}
+	question := &msg.Question[0]
+	do := false
+	ecs := ""
+	if opt := msg.IsEdns0(); opt != nil {
+		do = opt.Do()
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				ecs = subnetKey(subnet)
+				break
+			}
+		}
+	}
+	globalKey = fmt.Sprintf("%s %s %d %d %t %t", partition, strings.ToLower(question.Name), question.Qtype, question.Qclass, do, msg.CheckingDisabled)
+	key = globalKey
+	if ecs != "" {
+		key += " " + ecs
+	}
+	return key, globalKey, true
+}
+
+func subnetKey(subnet *dns.EDNS0_SUBNET) string {
+	bits := 32
+	if subnet.Family == 2 {
+		bits = 128
+	}
+	address := subnet.Address.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits))
+	if address == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", address.String(), subnet.SourceNetmask)
+}
+
+// matchSubnet rewrites the ECS option of a cached response to the subnet
+// of the request, keeping the scope. Entries shared by all clients would
+// otherwise return the subnet of the client which filled them.
+func matchSubnet(response, request *dns.Msg) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+	var requestSubnet *dns.EDNS0_SUBNET
+	if requestOpt := request.IsEdns0(); requestOpt != nil {
+		for _, option := range requestOpt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				requestSubnet = subnet
+				break
+			}
+		}
+	}
+	options := make([]dns.EDNS0, 0, len(opt.Option))
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			if requestSubnet == nil {
+				continue
+			}
+			// Options are shared with the cached entry by Copy
+			option = &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        requestSubnet.Family,
+				SourceNetmask: requestSubnet.SourceNetmask,
+				SourceScope:   subnet.SourceScope,
+				Address:       requestSubnet.Address,
+			}
+		}
+		options = append(options, option)
+	}
+	opt.Option = options
+}
+
+// responseScope returns the ECS scope prefix length of the response,
+// or -1 if the response carries no ECS option.
+func responseScope(response *dns.Msg) int {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return -1
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return int(subnet.SourceScope)
+		}
+	}
+	return -1
+}
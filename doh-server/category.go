@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Used when no categories are configured
+var defaultCategories = []categoryConfig{
+	{Name: "ads", Bit: 0, List: "adslist.*.txt"},
+}
+
+type categoryConfig struct {
+	Name string `toml:"name"`
+	Bit  uint   `toml:"bit"`
+	List string `toml:"list"`
+}
+
+// category is a named set of restricted domains, enabled per request by
+// its bit in the X-Filter-Categories header or by its name in the
+// "categories" query parameter
+type category struct {
+	name     string
+	mask     uint64
+	selector *regexp.Regexp
+}
+
+func newCategory(conf categoryConfig) (*category, error) {
+	if conf.Name == "" || strings.ContainsAny(conf.Name, ", ") {
+		return nil, fmt.Errorf("invalid category name %q", conf.Name)
+	}
+	if conf.Bit >= 64 {
+		return nil, fmt.Errorf("bit of category %q must be less than 64", conf.Name)
+	}
+	selector, err := listFileSelector(conf.List)
+	if err != nil {
+		return nil, fmt.Errorf("category %q: %v", conf.Name, err)
+	}
+	return &category{
+		name:     conf.Name,
+		mask:     uint64(1) << conf.Bit,
+		selector: selector,
+	}, nil
+}
+
+func newCategories(confs []categoryConfig) ([]*category, error) {
+	var categories []*category
+	var usedBits uint64
+	usedNames := map[string]bool{}
+	for _, conf := range confs {
+		c, err := newCategory(conf)
+		if err != nil {
+			return nil, err
+		}
+		if usedBits&c.mask != 0 {
+			return nil, fmt.Errorf("bit %d is used by more than one category", conf.Bit)
+		}
+		if usedNames[c.name] {
+			return nil, fmt.Errorf("category %q is defined more than once", c.name)
+		}
+		usedBits |= c.mask
+		usedNames[c.name] = true
+		categories = append(categories, c)
+	}
+	return categories, nil
+}
+
+// listFileSelector converts a pattern like "adslist.*.txt", where "*"
+// stands for the list generation number, to a regular expression
+func listFileSelector(pattern string) (*regexp.Regexp, error) {
+	if strings.Count(pattern, "*") != 1 {
+		return nil, fmt.Errorf("list pattern %q must contain exactly one \"*\"", pattern)
+	}
+	parts := strings.Split(pattern, "*")
+	return regexp.Compile("^" + regexp.QuoteMeta(parts[0]) + "(\\d+)" + regexp.QuoteMeta(parts[1]) + "$")
+}
+
+// parseFilterCategories reads the enabled categories of the request from
+// the X-Filter-Categories bitmask header and the "categories" query
+// parameter with comma-separated names
+func (s *Server) parseFilterCategories(r *http.Request) (uint64, error) {
+	var known uint64
+	for _, c := range s.state().categories {
+		known |= c.mask
+	}
+
+	var mask uint64
+	if header := r.Header.Get("X-Filter-Categories"); header != "" {
+		value, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid header value: \"X-Filter-Categories\" = %q", header)
+		}
+		if value&^known != 0 {
+			return 0, fmt.Errorf("Unknown filter categories: \"X-Filter-Categories\" = %q", header)
+		}
+		mask |= value
+	}
+
+	if names := r.FormValue("categories"); names != "" {
+		for _, name := range strings.Split(names, ",") {
+			c := s.categoryByName(strings.TrimSpace(name))
+			if c == nil {
+				return 0, fmt.Errorf("Unknown filter category: %q", name)
+			}
+			mask |= c.mask
+		}
+	}
+	return mask, nil
+}
+
+func (s *Server) categoryByName(name string) *category {
+	for _, c := range s.state().categories {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
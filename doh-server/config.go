@@ -25,6 +25,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/BurntSushi/toml"
 )
@@ -33,15 +34,60 @@ type config struct {
 	Listen              []string `toml:"listen"`
 	Cert                string   `toml:"cert"`
 	Key                 string   `toml:"key"`
+	NoQUIC              bool     `toml:"no_quic"`
+	NoTCPTLS            bool     `toml:"no_tcp_tls"`
 	Path                string   `toml:"path"`
 	Upstream            []string `toml:"upstream"`
+	UpstreamSelector    string   `toml:"upstream_selector"`
+	UpstreamMaxFailures uint     `toml:"upstream_max_failures"`
+	UpstreamMaxBackoff  uint     `toml:"upstream_max_backoff"`
+	UpstreamParallel    uint     `toml:"upstream_parallel"`
+	UpstreamHedgeDelay  uint     `toml:"upstream_hedge_delay"`
 	Timeout             uint     `toml:"timeout"`
 	Tries               uint     `toml:"tries"`
 	TCPOnly             bool     `toml:"tcp_only"`
 	Verbose             bool     `toml:"verbose"`
 	ListsDirectory      string   `toml:"lists_directory"`
+	ListsFormat         string   `toml:"lists_format"`
+	ListsMaxRegexps     int      `toml:"lists_max_regexps"`
 	ListsUpdateEndpoint string   `toml:"lists_update_endpoint"`
+	ListsWatch          bool     `toml:"lists_watch"`
+	ListsPollInterval   uint     `toml:"lists_poll_interval"`
+	LocalZones          []string `toml:"local_zones"`
+	LocalRecords        []string `toml:"local_records"`
+	BlockMode           string   `toml:"block_mode"`
+	BlockTTL            uint32   `toml:"block_ttl"`
+	SinkholeIPv4        string   `toml:"sinkhole_ipv4"`
+	SinkholeIPv6        string   `toml:"sinkhole_ipv6"`
 	RequestsLog         string   `toml:"requests_log"`
+	RequestsLogFields   []string `toml:"requests_log_fields"`
+	RequestsLogMaxSize  uint     `toml:"requests_log_max_size"`
+	RequestsLogMaxAge   uint     `toml:"requests_log_max_age"`
+	RequestsLogKeep     int      `toml:"requests_log_keep"`
+	RequestsLogCompress bool     `toml:"requests_log_compress"`
+	RequestsLogFlush    uint     `toml:"requests_log_flush_interval"`
+	RequestsLogQueue    int      `toml:"requests_log_queue_size"`
+	RequestsLogPolicy   string   `toml:"requests_log_queue_policy"`
+	ShutdownTimeout     uint     `toml:"shutdown_timeout"`
+	CacheSize           int      `toml:"cache_size"`
+	CacheMinTTL         uint32   `toml:"cache_min_ttl"`
+	CacheMaxTTL         uint32   `toml:"cache_max_ttl"`
+	CacheStaleTTL       uint     `toml:"cache_stale_ttl"`
+	CacheStaleAnswerTTL uint32   `toml:"cache_stale_answer_ttl"`
+	CachePrefetch       uint32   `toml:"cache_prefetch"`
+	AuthTokens          string   `toml:"auth_tokens"`
+	AuthClientCA        string   `toml:"auth_client_ca"`
+	RateLimit           uint     `toml:"rate_limit"`
+	RateLimitBurst      uint     `toml:"rate_limit_burst"`
+	RateLimitClients    int      `toml:"rate_limit_clients"`
+	RateLimitProxies    []string `toml:"rate_limit_trusted_proxies"`
+	RateLimitIPv6Prefix int      `toml:"rate_limit_ipv6_prefix"`
+	AdminListen         string   `toml:"admin_listen"`
+	AdminTokens         string   `toml:"admin_tokens"`
+	ListsOverlay        string   `toml:"lists_overlay"`
+
+	Categories []categoryConfig `toml:"category"`
+	Profiles   []profileConfig  `toml:"profile"`
 }
 
 func loadConfig(path string) (*config, error) {
@@ -64,20 +110,169 @@ func loadConfig(path string) (*config, error) {
 	if len(conf.Upstream) == 0 {
 		conf.Upstream = []string{"8.8.8.8:53", "8.8.4.4:53"}
 	}
+	for _, address := range conf.Upstream {
+		if _, err := parseUpstream(address); err != nil {
+			return nil, &configError{err.Error()}
+		}
+	}
+	switch conf.UpstreamSelector {
+	case "":
+		conf.UpstreamSelector = SelectorRandom
+	case SelectorRandom, SelectorRoundRobin, SelectorLowestLatency, SelectorFailover:
+	default:
+		return nil, &configError{fmt.Sprintf("unknown upstream_selector %q", conf.UpstreamSelector)}
+	}
+	if !metaData.IsDefined("upstream_max_failures") {
+		conf.UpstreamMaxFailures = 3
+	}
+	if conf.UpstreamMaxBackoff == 0 {
+		conf.UpstreamMaxBackoff = 300
+	}
 	if conf.Timeout == 0 {
 		conf.Timeout = 10
 	}
 	if conf.Tries == 0 {
 		conf.Tries = 1
 	}
+	if conf.UpstreamParallel == 0 {
+		conf.UpstreamParallel = 1
+	}
+	if conf.UpstreamParallel > conf.Tries {
+		return nil, &configError{"upstream_parallel must not be greater than tries"}
+	}
+	if conf.ShutdownTimeout == 0 {
+		conf.ShutdownTimeout = 10
+	}
+
+	if len(conf.RequestsLogFields) == 0 {
+		conf.RequestsLogFields = defaultTrackerFields
+	}
+	if err := checkTrackerFields(conf.RequestsLogFields); err != nil {
+		return nil, &configError{err.Error()}
+	}
+	if conf.RequestsLogFlush == 0 {
+		conf.RequestsLogFlush = 1
+	}
+	if conf.RequestsLogQueue <= 0 {
+		conf.RequestsLogQueue = 1000
+	}
+	switch conf.RequestsLogPolicy {
+	case "":
+		conf.RequestsLogPolicy = TrackerQueueDrop
+	case TrackerQueueDrop, TrackerQueueBlock:
+	default:
+		return nil, &configError{fmt.Sprintf("unknown requests_log_queue_policy %q", conf.RequestsLogPolicy)}
+	}
+	if conf.RequestsLogKeep < 0 {
+		return nil, &configError{"requests_log_keep must not be negative"}
+	}
+
+	if conf.CacheMaxTTL == 0 {
+		conf.CacheMaxTTL = 86400
+	}
+	if conf.CacheMinTTL > conf.CacheMaxTTL {
+		return nil, &configError{"cache_min_ttl must not be greater than cache_max_ttl"}
+	}
+	if !metaData.IsDefined("cache_stale_ttl") {
+		conf.CacheStaleTTL = 86400
+	}
+	if !metaData.IsDefined("cache_stale_answer_ttl") {
+		conf.CacheStaleAnswerTTL = 30
+	}
+	if !metaData.IsDefined("cache_prefetch") {
+		conf.CachePrefetch = 3
+	}
+
+	if conf.RateLimitBurst == 0 {
+		conf.RateLimitBurst = 50
+	}
+	if conf.RateLimitClients <= 0 {
+		conf.RateLimitClients = 65536
+	}
+	if conf.RateLimitIPv6Prefix == 0 {
+		conf.RateLimitIPv6Prefix = 64
+	}
+	if conf.RateLimitIPv6Prefix < 0 || conf.RateLimitIPv6Prefix > 128 {
+		return nil, &configError{"rate_limit_ipv6_prefix must be between 1 and 128"}
+	}
+	if _, err := parseTrustedProxies(conf.RateLimitProxies); err != nil {
+		return nil, &configError{err.Error()}
+	}
 
 	if (conf.Cert != "") != (conf.Key != "") {
 		return nil, &configError{"You must specify both -cert and -key to enable TLS"}
 	}
+	if conf.Cert != "" && conf.NoQUIC && conf.NoTCPTLS {
+		return nil, &configError{"no_quic and no_tcp_tls can't be both enabled"}
+	}
+	if conf.AuthClientCA != "" && (conf.Cert == "" || conf.NoTCPTLS) {
+		return nil, &configError{"auth_client_ca needs TLS over TCP"}
+	}
+	// The gQUIC handshake of quic-go can't verify client certificates, so
+	// they would be silently ignored there
+	if conf.AuthClientCA != "" && !conf.NoQUIC {
+		return nil, &configError{"auth_client_ca needs no_quic, QUIC has no client certificates"}
+	}
+
+	if conf.ListsFormat == "" {
+		conf.ListsFormat = ListFormatAuto
+	}
+	if err := checkListFormat(conf.ListsFormat); err != nil {
+		return nil, &configError{err.Error()}
+	}
+	if !metaData.IsDefined("lists_max_regexps") {
+		conf.ListsMaxRegexps = 100
+	}
+	if !metaData.IsDefined("lists_watch") {
+		conf.ListsWatch = true
+	}
+	if !metaData.IsDefined("lists_poll_interval") {
+		conf.ListsPollInterval = 10
+	}
+	if conf.ListsPollInterval == 0 {
+		return nil, &configError{"lists_poll_interval must be positive"}
+	}
+
+	if len(conf.Categories) == 0 {
+		conf.Categories = defaultCategories
+	}
+	categories, err := newCategories(conf.Categories)
+	if err != nil {
+		return nil, &configError{err.Error()}
+	}
+
+	if conf.BlockMode == "" {
+		conf.BlockMode = BlockModeNXDomain
+	}
+	if err := checkBlockMode(conf.BlockMode); err != nil {
+		return nil, &configError{err.Error()}
+	}
+	if !metaData.IsDefined("block_ttl") {
+		conf.BlockTTL = 3600
+	}
+	if conf.SinkholeIPv4 == "" {
+		conf.SinkholeIPv4 = "0.0.0.0"
+	}
+	if ip := net.ParseIP(conf.SinkholeIPv4); ip == nil || ip.To4() == nil {
+		return nil, &configError{fmt.Sprintf("invalid sinkhole_ipv4 %q", conf.SinkholeIPv4)}
+	}
+	if conf.SinkholeIPv6 == "" {
+		conf.SinkholeIPv6 = "::"
+	}
+	if ip := net.ParseIP(conf.SinkholeIPv6); ip == nil || ip.To4() != nil {
+		return nil, &configError{fmt.Sprintf("invalid sinkhole_ipv6 %q", conf.SinkholeIPv6)}
+	}
+
+	if _, err := newProfiles(conf, categories); err != nil {
+		return nil, &configError{err.Error()}
+	}
 
 	if conf.ListsUpdateEndpoint != "" {
 		conf.ListsUpdateEndpoint = "http://" + conf.ListsUpdateEndpoint
 	}
+	if conf.AdminTokens != "" && (conf.AdminListen == "" || conf.ListsOverlay == "") {
+		return nil, &configError{"admin_tokens needs admin_listen and lists_overlay"}
+	}
 
 	return conf, nil
 }
@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// dirWatcher sends to events when files in a directory are created,
+// removed, renamed or written
+type dirWatcher struct {
+	events chan struct{}
+
+	mu     sync.Mutex
+	fd     int
+	wd     int
+	closed bool
+}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	mask := syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+	wd, err := syscall.InotifyAddWatch(fd, dir, uint32(mask))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	w := &dirWatcher{
+		events: make(chan struct{}, 1),
+		fd:     fd,
+		wd:     wd,
+	}
+	go w.read()
+	return w, nil
+}
+
+// read forwards inotify events until the watch is removed by close or
+// because the directory is gone, then closes events
+func (w *dirWatcher) read() {
+	defer close(w.events)
+	defer func() {
+		w.mu.Lock()
+		w.closed = true
+		syscall.Close(w.fd)
+		w.mu.Unlock()
+	}()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Printf("[Warning] Unable to read inotify events: %v", err)
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				return
+			}
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+		}
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close removes the watch, which makes the kernel wake up read
+func (w *dirWatcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		syscall.InotifyRmWatch(w.fd, uint32(w.wd))
+	}
+}
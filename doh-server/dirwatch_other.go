@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// dirWatcher is only implemented on Linux, elsewhere lists are polled
+type dirWatcher struct {
+	events chan struct{}
+}
+
+func newDirWatcher(dir string) (*dirWatcher, error) {
+	return nil, errors.New("not supported on this platform")
+}
+
+func (w *dirWatcher) close() {}
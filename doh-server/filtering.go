@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -16,42 +14,6 @@ import (
 	"github.com/miekg/dns"
 )
 
-const CategoryAds = uint64(1)
-
-func parseList(filepath string) (map[string]bool, error) {
-	file, err := os.Open(filepath)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	result := map[string]bool{}
-
-	reader := bufio.NewReader(file)
-	line := []byte{}
-	for ; ; line = line[:0] {
-		chunk, isPrefix, err := reader.ReadLine()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		line = append(line, chunk...)
-		if isPrefix {
-			continue
-		}
-		domain := strings.ToLower(strings.TrimSpace(string(line)))
-		if domain == "" {
-			continue
-		}
-		fqdn := dns.Fqdn(domain)
-		result[fqdn] = true
-	}
-
-	return result, nil
-}
-
 // Prelookup for domains filtering
 func (s *Server) preLookup(req *DNSRequest) {
 	if len(req.request.Question) != 1 {
@@ -63,6 +25,18 @@ func (s *Server) preLookup(req *DNSRequest) {
 		req.errcode = 400
 		req.errtext = "Non-query opcodes are unsupported"
 	}
+
+	if req.errcode != 0 {
+		return
+	}
+	// Never ask upstreams about restricted names
+	name := req.request.Question[0].Name
+	if list, listName := s.restrictedBy(name, req); list != "" {
+		req.response = s.blockResponse(req.request, req.profile.blockMode)
+		req.blocked = true
+		req.blockedName = name
+		req.blockedList, req.blockedListName = list, listName
+	}
 }
 
 // Filtering according to White/Black lists
@@ -70,20 +44,9 @@ func (s *Server) postLookup(resp *DNSRequest) {
 	// Uncheck authoritative answer because this server is just resolver.
 	resp.response.Authoritative = false
 
-	answer := make([]dns.RR, 0)
-	for _, rr := range resp.response.Answer {
-		if s.isRestricted(rr.Header().Name, resp.filterCategories) {
-			// Drop this RR from answer
-			// fmt.Printf("Dropping RR: %v\n", rr)
-			continue
-		}
-		answer = append(answer, rr)
-	}
-	resp.response.Answer = answer
-
 	additional := make([]dns.RR, 0)
 	for _, rr := range resp.response.Extra {
-		if s.isRestricted(rr.Header().Name, resp.filterCategories) {
+		if s.isRestricted(rr.Header().Name, resp) {
 			// Drop this RR from additional
 			// fmt.Printf("Dropping RR: %v\n", rr)
 			continue
@@ -96,70 +59,233 @@ func (s *Server) postLookup(resp *DNSRequest) {
 	// Also client can try to lookup domains out of our server through servers
 	// from this section.
 	resp.response.Ns = []dns.RR{}
+
+	s.checkAnswer(resp)
+}
+
+// checkAnswer replaces the whole answer if it contains a restricted
+// name. Partially dropped answers look like upstream failures and would
+// be cached by clients.
+func (s *Server) checkAnswer(resp *DNSRequest) {
+	if name := s.restrictedAnswerName(resp); name != "" {
+		log.Printf("Blocking %s: %s in the answer is restricted", resp.request.Question[0].Name, name)
+		resp.response = s.blockResponse(resp.request, resp.profile.blockMode)
+		resp.blocked = true
+		resp.blockedName = name
+		resp.blockedList, resp.blockedListName = s.restrictedBy(name, resp)
+	}
+}
+
+// restrictedAnswerName follows the CNAME and DNAME chain of the answer
+// starting at the question name and returns the first restricted alias
+// or target. Trackers hide behind first-party aliases this way.
+func (s *Server) restrictedAnswerName(resp *DNSRequest) string {
+	answer := resp.response.Answer
+	name := strings.ToLower(resp.request.Question[0].Name)
+	seen := map[string]bool{}
+	for name != "" && !seen[name] {
+		seen[name] = true
+		if s.isRestricted(name, resp) {
+			return name
+		}
+		next := ""
+		for _, rr := range answer {
+			owner := strings.ToLower(rr.Header().Name)
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				if owner == name {
+					next = strings.ToLower(rr.Target)
+				}
+			case *dns.DNAME:
+				if owner != name && dns.IsSubDomain(owner, name) {
+					next = name[:len(name)-len(owner)] + strings.ToLower(rr.Target)
+				}
+			}
+		}
+		name = next
+	}
+
+	// Records outside of the chain
+	for _, rr := range answer {
+		if s.isRestricted(rr.Header().Name, resp) {
+			return rr.Header().Name
+		}
+		if dname, ok := rr.(*dns.DNAME); ok && s.isRestricted(dname.Target, resp) {
+			return dname.Target
+		}
+	}
+	return ""
+}
+
+func (s *Server) isRestricted(domain string, req *DNSRequest) bool {
+	list, _ := s.restrictedBy(domain, req)
+	return list != ""
+}
+
+// restrictedBy returns the kind of list which restricts the name,
+// "profile", "overlay", "category" or "blacklist", and the profile ID or
+// category name.
+func (s *Server) restrictedBy(domain string, req *DNSRequest) (list string, name string) {
+	m := s.matchLists(strings.ToLower(dns.Fqdn(domain)), req.profile, req.filterCategories)
+	if !m.blocked {
+		return "", ""
+	}
+	return m.list, m.name
+}
+
+// listMatch is the list which decided whether a name is restricted
+type listMatch struct {
+	blocked bool
+	// Kind of the list, empty if no list matched
+	list string
+	// Profile ID or category name
+	name    string
+	domains *domainList
 }
 
-func (s *Server) isRestricted(domain string, categories uint64) bool {
-	normalized := strings.ToLower(dns.Fqdn(domain))
-	s.listsMu.RLock()
-	defer s.listsMu.RUnlock()
+// matchLists checks a lower-cased FQDN against the entries of the
+// profile, the entries added with the admin API, the enabled categories
+// and the global lists, in this order.
+func (s *Server) matchLists(fqdn string, p *profile, filterCategories uint64) listMatch {
+	if m, ok := matchAllowDeny(fqdn, p.allow, p.deny); ok {
+		m.list, m.name = "profile", p.id
+		return m
+	}
+	if s.overlay != nil {
+		lists := s.overlay.lists()
+		if m, ok := matchAllowDeny(fqdn, lists.allow, lists.deny); ok {
+			m.list = "overlay"
+			return m
+		}
+	}
+
+	lists := s.filterLists()
+	for _, c := range s.state().categories {
+		if filterCategories&c.mask == 0 {
+			continue
+		}
+		if _, ok := lists.categories[c.name].Match(fqdn); ok {
+			return listMatch{blocked: true, list: "category", name: c.name, domains: lists.categories[c.name]}
+		}
+	}
 
-	if categories&CategoryAds != 0 && s.adsList[normalized] {
-		return true
+	// The most specific rule wins, whitelist wins a tie
+	blackDepth, blacklisted := lists.blacklist.Match(fqdn)
+	if !blacklisted {
+		return listMatch{}
 	}
+	whiteDepth, whitelisted := lists.whitelist.Match(fqdn)
+	if whitelisted && blackDepth <= whiteDepth {
+		return listMatch{list: "whitelist", domains: lists.whitelist}
+	}
+	return listMatch{blocked: true, list: "blacklist", domains: lists.blacklist}
+}
 
-	if s.whitelist[normalized] {
-		return false
+// matchAllowDeny returns the matching list of a pair. The most specific
+// entry wins, allow wins a tie.
+func matchAllowDeny(fqdn string, allow, deny *domainList) (m listMatch, ok bool) {
+	denyDepth, denied := deny.Match(fqdn)
+	allowDepth, allowed := allow.Match(fqdn)
+	if denied && (!allowed || denyDepth > allowDepth) {
+		return listMatch{blocked: true, domains: deny}, true
+	}
+	if allowed {
+		return listMatch{domains: allow}, true
 	}
-	return s.blacklist[normalized]
+	return listMatch{}, false
+}
+
+var (
+	whitelistRE = regexp.MustCompile("^whitelist\\.(\\d+)\\.txt$")
+	blacklistRE = regexp.MustCompile("^blacklist\\.(\\d+)\\.txt$")
+)
+
+// filterLists are the lists read from lists_directory. They are
+// replaced as a whole and never modified.
+type filterLists struct {
+	whitelist *domainList
+	blacklist *domainList
+	// Lists of categories by name
+	categories map[string]*domainList
+	// Records of local_zones and local_records
+	local *localData
 }
 
 func (s *Server) readLists() error {
-	if s.conf.ListsDirectory == "" {
-		log.Print("No filtering lists are used")
-		return nil
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	lists, err := s.loadLists(s.state())
+	if err != nil {
+		return err
 	}
-	whitelistRE := regexp.MustCompile("^whitelist\\.(\\d+)\\.txt$")
-	whitelist, err := readList(s.conf.ListsDirectory, whitelistRE)
+	s.setLists(lists)
+	return nil
+}
+
+// loadLists reads the lists for the given state without using them
+func (s *Server) loadLists(state *serverState) (lists *filterLists, err error) {
+	conf := state.conf
+	lists = newFilterLists()
+	lists.local, err = loadLocalData(conf)
 	if err != nil {
-		return fmt.Errorf("can't read whitelist: %v", err)
+		return nil, err
+	}
+	if conf.ListsDirectory == "" {
+		log.Print("No filtering lists are used")
+		return lists, nil
 	}
-	s.listsMu.Lock()
-	s.whitelist = whitelist
-	s.listsMu.Unlock()
+	defer func() { s.metrics.listsReloaded(err) }()
 
-	blacklistRE := regexp.MustCompile("^blacklist\\.(\\d+)\\.txt$")
-	blacklist, err := readList(s.conf.ListsDirectory, blacklistRE)
+	lists.whitelist, err = readList(conf, whitelistRE)
 	if err != nil {
-		return fmt.Errorf("Can't read blacklist: %v", err)
+		return nil, fmt.Errorf("can't read whitelist: %v", err)
 	}
-	s.listsMu.Lock()
-	s.blacklist = blacklist
-	s.listsMu.Unlock()
 
-	adsRE := regexp.MustCompile("^adslist\\.(\\d+)\\.txt$")
-	adsList, err := readList(s.conf.ListsDirectory, adsRE)
+	lists.blacklist, err = readList(conf, blacklistRE)
 	if err != nil {
-		return fmt.Errorf("Can't read ads list: %v", err)
+		return nil, fmt.Errorf("Can't read blacklist: %v", err)
 	}
-	s.listsMu.Lock()
-	s.adsList = adsList
-	s.listsMu.Unlock()
 
-	s.listsMu.RLock()
-	log.Printf("Blacklist size: %v", len(s.blacklist))
-	log.Printf("Whitelist size: %v", len(s.whitelist))
-	log.Printf("Ads list size: %v", len(s.adsList))
-	s.listsMu.RUnlock()
+	for _, c := range state.categories {
+		list, err := readList(conf, c.selector)
+		if err != nil {
+			return nil, fmt.Errorf("Can't read %s list: %v", c.name, err)
+		}
+		lists.categories[c.name] = list
+	}
 
-	return nil
+	log.Printf("Blacklist size: %v", lists.blacklist.Len())
+	log.Printf("Whitelist size: %v", lists.whitelist.Len())
+	for _, c := range state.categories {
+		log.Printf("Category %s list size: %v", c.name, lists.categories[c.name].Len())
+	}
+	return lists, nil
 }
 
-func readList(dir string, selector *regexp.Regexp) (map[string]bool, error) {
+func newFilterLists() *filterLists {
+	return &filterLists{
+		whitelist:  newDomainList(),
+		blacklist:  newDomainList(),
+		categories: map[string]*domainList{},
+		local:      newLocalData(),
+	}
+}
+
+func (s *Server) filterLists() *filterLists {
+	return s.lists.Load().(*filterLists)
+}
+
+func (s *Server) setLists(lists *filterLists) {
+	s.lists.Store(lists)
+}
+
+func readList(conf *config, selector *regexp.Regexp) (*domainList, error) {
+	dir := conf.ListsDirectory
 	listName, err := getMaxNumberFilenameForRE(dir, selector)
 	if err != nil {
 		return nil, err
 	}
-	list, err := parseList(path.Join(dir, listName))
+	list, err := parseList(path.Join(dir, listName), conf.ListsFormat, conf.ListsMaxRegexps)
 	if err != nil {
 		return nil, fmt.Errorf("Can't read whitelist: %v", err)
 	}
@@ -213,7 +339,8 @@ func (s *Server) startListsUpdateEndpoint() error {
 		return err
 	}
 
-	http.HandleFunc(theURL.Path, func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(theURL.Path, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.WriteHeader(400)
 			fmt.Fprintf(w, "Bad request")
@@ -230,9 +357,13 @@ func (s *Server) startListsUpdateEndpoint() error {
 		}()
 	})
 
+	server := &http.Server{Addr: theURL.Host, Handler: mux}
+	if !s.listeners.addHTTP(server) {
+		return nil
+	}
 	go func() {
-		err := http.ListenAndServe(theURL.Host, nil)
-		if err != nil {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Unable to start update lists endpoint: %v", err)
 		}
 	}()
@@ -39,8 +39,13 @@ import (
 )
 
 func (s *Server) parseRequestGoogle(w http.ResponseWriter, r *http.Request) *DNSRequest {
-	categoriesStr := r.Header.Get("X-Filter-Categories")
-	categories, _ := strconv.ParseUint(categoriesStr, 10, 64)
+	categories, err := s.parseFilterCategories(r)
+	if err != nil {
+		return &DNSRequest{
+			errcode: 400,
+			errtext: err.Error(),
+		}
+	}
 
 	dntHeader := r.Header.Get("DNT")
 	dnt := false
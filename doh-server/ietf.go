@@ -63,8 +63,13 @@ func (s *Server) parseRequestIETF(w http.ResponseWriter, r *http.Request) *DNSRe
 		}
 	}
 
-	categoriesStr := r.Header.Get("X-Filter-Categories")
-	categories, _ := strconv.ParseUint(categoriesStr, 10, 64)
+	categories, err := s.parseFilterCategories(r)
+	if err != nil {
+		return &DNSRequest{
+			errcode: 400,
+			errtext: err.Error(),
+		}
+	}
 
 	dntHeader := r.Header.Get("DNT")
 	dnt := false
@@ -88,7 +93,7 @@ func (s *Server) parseRequestIETF(w http.ResponseWriter, r *http.Request) *DNSRe
 		}
 	}
 
-	if s.conf.Verbose && len(msg.Question) > 0 {
+	if s.state().conf.Verbose && len(msg.Question) > 0 {
 		question := &msg.Question[0]
 		questionName := question.Name
 		questionClass := ""
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/ProfitLabs/quic-dns/domain-table"
+	"github.com/miekg/dns"
+)
+
+// Filtering list formats
+const (
+	// Detect the format of every line
+	ListFormatAuto = "auto"
+	// One domain per line, "*.example.com" covers subdomains
+	ListFormatDomains = "domains"
+	// "0.0.0.0 example.com" lines of a hosts file
+	ListFormatHosts = "hosts"
+	// Adblock Plus "||example.com^", "@@||example.com^" and "/regex/" rules
+	ListFormatAdblock = "adblock"
+)
+
+// Names found in most hosts files which must never be filtered
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+}
+
+// domainList is a parsed filtering list. Domains are added to the
+// builders while parsing and can be matched after freeze.
+type domainList struct {
+	rules            *domainTable.Table
+	exceptions       *domainTable.Table
+	regexps          []*regexp.Regexp
+	exceptionRegexps []*regexp.Regexp
+
+	ruleBuilder      *domainTable.Builder
+	exceptionBuilder *domainTable.Builder
+}
+
+type listStats struct {
+	accepted   int
+	rejected   int
+	duplicates int
+}
+
+func newDomainList() *domainList {
+	return &domainList{
+		ruleBuilder:      &domainTable.Builder{},
+		exceptionBuilder: &domainTable.Builder{},
+	}
+}
+
+// freeze builds the tables of the added domains, which are counted as
+// accepted until duplicates are found here
+func (l *domainList) freeze(stats *listStats) {
+	var ruleDuplicates, exceptionDuplicates int
+	l.rules, ruleDuplicates = l.ruleBuilder.Build()
+	l.exceptions, exceptionDuplicates = l.exceptionBuilder.Build()
+	stats.accepted -= ruleDuplicates + exceptionDuplicates
+	stats.duplicates += ruleDuplicates + exceptionDuplicates
+	l.ruleBuilder, l.exceptionBuilder = nil, nil
+}
+
+// Match looks up a lower-cased FQDN and returns the number of labels of
+// the most specific matching rule. Exception rules of the same list
+// override rules which are not more specific than the exception.
+func (l *domainList) Match(fqdn string) (depth int, ok bool) {
+	if l == nil {
+		return 0, false
+	}
+	depth, ok = l.rules.Match(fqdn)
+	if !ok && matchRegexps(l.regexps, fqdn) {
+		depth, ok = dns.CountLabel(fqdn), true
+	}
+	if !ok {
+		return
+	}
+	exceptionDepth, excepted := l.exceptions.Match(fqdn)
+	if !excepted && matchRegexps(l.exceptionRegexps, fqdn) {
+		exceptionDepth, excepted = dns.CountLabel(fqdn), true
+	}
+	if excepted && exceptionDepth >= depth {
+		return 0, false
+	}
+	return
+}
+
+// Rule describes the rule which makes Match return true for fqdn, e.g.
+// "*.example.com" or "/^ad[0-9]+\./"
+func (l *domainList) Rule(fqdn string) (rule string, ok bool) {
+	if _, ok := l.Match(fqdn); !ok {
+		return "", false
+	}
+	if name, subdomains, ok := l.rules.Rule(fqdn); ok {
+		if subdomains {
+			return "*." + name, true
+		}
+		return name, true
+	}
+	name := strings.TrimSuffix(fqdn, ".")
+	for _, re := range l.regexps {
+		if re.MatchString(name) {
+			return "/" + re.String() + "/", true
+		}
+	}
+	return "", false
+}
+
+func (l *domainList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return l.rules.Len() + len(l.regexps)
+}
+
+func matchRegexps(regexps []*regexp.Regexp, fqdn string) bool {
+	if len(regexps) == 0 {
+		return false
+	}
+	name := strings.TrimSuffix(fqdn, ".")
+	for _, re := range regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseList reads a filtering list in the given format.
+// "*.example.com" and "||example.com^" match example.com and all of its
+// subdomains, any other entry matches the domain only.
+// At most maxRegexps regular expression rules are accepted.
+func parseList(filepath string, format string, maxRegexps int) (*domainList, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := newDomainList()
+	stats := listStats{}
+
+	reader := bufio.NewReader(file)
+	line := []byte{}
+	for ; ; line = line[:0] {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if isPrefix {
+			continue
+		}
+		result.parseLine(strings.TrimSpace(string(line)), format, maxRegexps, &stats)
+	}
+	result.freeze(&stats)
+
+	log.Printf("List %s: %d accepted, %d rejected, %d duplicate entries", path.Base(filepath), stats.accepted, stats.rejected, stats.duplicates)
+	return result, nil
+}
+
+func (l *domainList) parseLine(line string, format string, maxRegexps int, stats *listStats) {
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		// Comments and Adblock Plus headers
+		return
+	}
+
+	auto := format == ListFormatAuto
+	fields := strings.Fields(line)
+	switch {
+	case (auto || format == ListFormatHosts) && len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+		for _, name := range fields[1:] {
+			if name[0] == '#' {
+				break
+			}
+			name = strings.ToLower(name)
+			if hostsLocalNames[name] || net.ParseIP(name) != nil {
+				continue
+			}
+			l.addDomain(name, false, false, stats)
+		}
+	case (auto || format == ListFormatAdblock) && isAdblockRule(line):
+		l.addAdblockRule(line, maxRegexps, stats)
+	case (auto || format == ListFormatDomains) && (len(fields) == 1 || fields[1][0] == '#'):
+		domain := strings.ToLower(fields[0])
+		subdomains := false
+		if strings.HasPrefix(domain, "*.") {
+			domain = domain[2:]
+			subdomains = true
+		}
+		l.addDomain(domain, subdomains, false, stats)
+	default:
+		stats.rejected++
+	}
+}
+
+func isAdblockRule(line string) bool {
+	line = strings.TrimPrefix(line, "@@")
+	return strings.HasPrefix(line, "||") || (len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/')
+}
+
+func (l *domainList) addAdblockRule(line string, maxRegexps int, stats *listStats) {
+	exception := strings.HasPrefix(line, "@@")
+	rule := strings.TrimPrefix(line, "@@")
+
+	if rule[0] == '/' {
+		if len(l.regexps)+len(l.exceptionRegexps) >= maxRegexps {
+			stats.rejected++
+			return
+		}
+		re, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			stats.rejected++
+			return
+		}
+		if exception {
+			l.exceptionRegexps = append(l.exceptionRegexps, re)
+		} else {
+			l.regexps = append(l.regexps, re)
+		}
+		stats.accepted++
+		return
+	}
+
+	// Only options which don't narrow the rule down make sense for DNS
+	if dollar := strings.IndexByte(rule, '$'); dollar >= 0 {
+		for _, option := range strings.Split(rule[dollar+1:], ",") {
+			if option != "important" && option != "all" {
+				stats.rejected++
+				return
+			}
+		}
+		rule = rule[:dollar]
+	}
+	if !strings.HasSuffix(rule, "^") && !strings.HasSuffix(rule, "^|") {
+		stats.rejected++
+		return
+	}
+	domain := strings.TrimSuffix(strings.TrimSuffix(rule[2:], "|"), "^")
+	l.addDomain(strings.ToLower(domain), true, exception, stats)
+}
+
+func (l *domainList) addDomain(domain string, subdomains bool, exception bool, stats *listStats) {
+	if _, ok := dns.IsDomainName(domain); !ok || domain == "" || strings.ContainsAny(domain, "/*^|$ ") {
+		stats.rejected++
+		return
+	}
+	builder := l.ruleBuilder
+	if exception {
+		builder = l.exceptionBuilder
+	}
+	builder.Add(domain, subdomains)
+	stats.accepted++
+}
+
+func checkListFormat(format string) error {
+	switch format {
+	case ListFormatAuto, ListFormatDomains, ListFormatHosts, ListFormatAdblock:
+		return nil
+	}
+	return fmt.Errorf("unknown lists_format %q", format)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Lists are reloaded once their files haven't changed for this long, so
+// that files which are still being written are not read
+const listsSettleDelay = 2 * time.Second
+
+// watchLists rereads the lists when files in lists_directory change. It
+// follows changes of lists_directory, lists_watch and
+// lists_poll_interval made by Reload.
+func (s *Server) watchLists() {
+	var (
+		dir      string
+		watcher  *dirWatcher
+		events   <-chan struct{}
+		interval time.Duration
+		ticker   *time.Ticker
+		loaded   string
+	)
+	for {
+		conf := s.state().conf
+		watchDir := ""
+		if conf.ListsWatch {
+			watchDir = conf.ListsDirectory
+		}
+		if watchDir != dir {
+			if watcher != nil {
+				watcher.close()
+				watcher, events = nil, nil
+			}
+			dir = watchDir
+			if dir != "" {
+				var err error
+				watcher, err = newDirWatcher(dir)
+				if err != nil {
+					log.Printf("[Warning] Unable to watch %s, polling it instead: %v", dir, err)
+				} else {
+					events = watcher.events
+				}
+			}
+			// The lists were just read by Start or Reload
+			loaded = s.listsSnapshot(dir)
+		}
+		if d := time.Duration(conf.ListsPollInterval) * time.Second; d != interval {
+			if ticker != nil {
+				ticker.Stop()
+			}
+			interval = d
+			ticker = time.NewTicker(interval)
+		}
+
+		select {
+		case _, ok := <-events:
+			if !ok {
+				log.Printf("[Warning] Stopped watching %s, polling it instead", dir)
+				events = nil
+			}
+		case <-ticker.C:
+		}
+		if dir == "" || s.listsSnapshot(dir) == loaded {
+			continue
+		}
+
+		loaded = s.waitForLists(dir)
+		log.Printf("Lists in %s have changed, rereading them", dir)
+		if err := s.readLists(); err != nil {
+			log.Printf("[Warning] Unable to reread lists, keeping the old ones: %v", err)
+		}
+	}
+}
+
+// waitForLists waits until the list files in dir stop changing and
+// returns their snapshot
+func (s *Server) waitForLists(dir string) string {
+	snapshot := s.listsSnapshot(dir)
+	for {
+		time.Sleep(listsSettleDelay)
+		next := s.listsSnapshot(dir)
+		if next == snapshot {
+			return snapshot
+		}
+		snapshot = next
+	}
+}
+
+// listsSnapshot describes names, sizes and modification times of the
+// list files in dir and the files of local_zones and local_records
+func (s *Server) listsSnapshot(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	state := s.state()
+	selectors := []*regexp.Regexp{whitelistRE, blacklistRE}
+	for _, c := range state.categories {
+		selectors = append(selectors, c.selector)
+	}
+
+	var snapshot strings.Builder
+	for _, files := range [][]string{state.conf.LocalZones, state.conf.LocalRecords} {
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				fmt.Fprintf(&snapshot, "%s %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+			}
+		}
+	}
+	for _, info := range infos {
+		for _, selector := range selectors {
+			if selector.MatchString(info.Name()) {
+				fmt.Fprintf(&snapshot, "%s %d %d\n", info.Name(), info.Size(), info.ModTime().UnixNano())
+				break
+			}
+		}
+	}
+	return snapshot.String()
+}
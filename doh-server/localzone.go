@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Longest CNAME chain followed in local data
+const localMaxCNAMEs = 8
+
+// localData are the records of local_zones and local_records. They are
+// read with the lists and never modified.
+type localData struct {
+	// Zones by lower-cased origin
+	zones map[string]*localZone
+	// Records of local_records by lower-cased owner name
+	records map[string][]dns.RR
+}
+
+type localZone struct {
+	origin string
+	soa    *dns.SOA
+	// Records by lower-cased owner name. Names without records between
+	// the origin and other names are present with no records.
+	names map[string][]dns.RR
+}
+
+// localAnswer is the local answer for a single name
+type localAnswer struct {
+	rcode  int
+	answer []dns.RR
+	// SOA record of negative answers, nil for local_records
+	soa *dns.SOA
+	// The answer comes from a zone
+	authoritative bool
+}
+
+func newLocalData() *localData {
+	return &localData{
+		zones:   map[string]*localZone{},
+		records: map[string][]dns.RR{},
+	}
+}
+
+func loadLocalData(conf *config) (*localData, error) {
+	d := newLocalData()
+	for _, file := range conf.LocalZones {
+		z, err := readZone(file)
+		if err != nil {
+			return nil, fmt.Errorf("can't read local zone: %v", err)
+		}
+		if d.zones[z.origin] != nil {
+			return nil, fmt.Errorf("can't read local zone: %s: zone %s is defined twice", file, z.origin)
+		}
+		d.zones[z.origin] = z
+	}
+	count := 0
+	for _, file := range conf.LocalRecords {
+		err := parseZoneFile(file, func(rr dns.RR) error {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				return fmt.Errorf("SOA records belong into local_zones")
+			}
+			name := strings.ToLower(rr.Header().Name)
+			d.records[name] = append(d.records[name], rr)
+			count++
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't read local records: %v", err)
+		}
+	}
+
+	if len(conf.LocalZones) != 0 || len(conf.LocalRecords) != 0 {
+		log.Printf("Local zones: %d, local records: %d", len(d.zones), count)
+	}
+	return d, nil
+}
+
+// readZone reads a zone file with exactly one SOA record, whose owner is
+// the origin of the zone. Relative names need an $ORIGIN directive.
+func readZone(file string) (*localZone, error) {
+	var records []dns.RR
+	z := &localZone{names: map[string][]dns.RR{}}
+	err := parseZoneFile(file, func(rr dns.RR) error {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if z.soa != nil {
+				return fmt.Errorf("more than one SOA record")
+			}
+			z.soa = soa
+			z.origin = strings.ToLower(soa.Hdr.Name)
+		}
+		records = append(records, rr)
+		return nil
+	})
+	if err == nil && z.soa == nil {
+		err = fmt.Errorf("%s: no SOA record", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("%s: %s is outside of zone %s", file, rr.Header().Name, z.origin)
+		}
+		z.names[name] = append(z.names[name], rr)
+		for name != z.origin {
+			name = parentName(name)
+			if _, ok := z.names[name]; !ok {
+				z.names[name] = nil
+			}
+		}
+	}
+	return z, nil
+}
+
+func parseZoneFile(file string, add func(rr dns.RR) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tokens := dns.ParseZone(f, ".", file)
+	// Let the parser finish in any case
+	defer func() {
+		for range tokens {
+		}
+	}()
+	for token := range tokens {
+		if token.Error != nil {
+			return token.Error
+		}
+		if token.RR.Header().Class != dns.ClassINET {
+			return fmt.Errorf("%s: %s is not of class IN", file, token.RR.Header().Name)
+		}
+		if err := add(token.RR); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// lookup answers a question locally if the name is listed in
+// local_records or belongs to a zone. Records of local_records win over
+// zones, and "*.example.com" records there cover all subdomains which
+// are not listed themselves.
+func (d *localData) lookup(name string, qtype uint16) (a *localAnswer, ok bool) {
+	lower := strings.ToLower(dns.Fqdn(name))
+	zone := d.zone(lower)
+
+	rrs, found := d.records[lower]
+	for parent := lower; !found && parent != "."; {
+		parent = parentName(parent)
+		rrs, found = d.records[wildcardName(parent)]
+	}
+	if found {
+		a = &localAnswer{rcode: dns.RcodeSuccess, answer: selectRecords(rrs, name, qtype)}
+		if len(a.answer) == 0 && zone != nil {
+			a.soa = zone.negativeSOA()
+		}
+		return a, true
+	}
+
+	if zone == nil {
+		return nil, false
+	}
+	a = &localAnswer{rcode: dns.RcodeSuccess, authoritative: true}
+	rrs, found = zone.names[lower]
+	if !found {
+		// Wildcards are only used below the closest existing name, see
+		// RFC 4592
+		encloser := parentName(lower)
+		for {
+			if _, ok := zone.names[encloser]; ok {
+				break
+			}
+			encloser = parentName(encloser)
+		}
+		rrs, found = zone.names[wildcardName(encloser)]
+	}
+	if !found {
+		a.rcode = dns.RcodeNameError
+	} else {
+		a.answer = selectRecords(rrs, name, qtype)
+	}
+	if len(a.answer) == 0 {
+		a.soa = zone.negativeSOA()
+	}
+	return a, true
+}
+
+// zone returns the most specific zone of a lower-cased FQDN
+func (d *localData) zone(name string) *localZone {
+	if len(d.zones) == 0 {
+		return nil
+	}
+	for {
+		if z := d.zones[name]; z != nil {
+			return z
+		}
+		if name == "." {
+			return nil
+		}
+		name = parentName(name)
+	}
+}
+
+// negativeSOA returns the SOA record for NXDOMAIN and NODATA answers,
+// which is cached for the shorter of its TTL and minimum, see RFC 2308
+func (z *localZone) negativeSOA() *dns.SOA {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// selectRecords returns copies of the records of qtype, or of the CNAME
+// record, owned by name
+func selectRecords(rrs []dns.RR, name string, qtype uint16) []dns.RR {
+	var result []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype || qtype == dns.TypeANY {
+			result = append(result, rr)
+		}
+	}
+	if len(result) == 0 {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeCNAME {
+				result = append(result, rr)
+				break
+			}
+		}
+	}
+	for i, rr := range result {
+		result[i] = dns.Copy(rr)
+		result[i].Header().Name = name
+	}
+	return result
+}
+
+// parentName returns the parent of a FQDN other than the root
+func parentName(name string) string {
+	if dot := strings.IndexByte(name, '.'); dot >= 0 && dot+1 < len(name) {
+		return name[dot+1:]
+	}
+	return "."
+}
+
+func wildcardName(parent string) string {
+	if parent == "." {
+		return "*."
+	}
+	return "*." + parent
+}
+
+// answerLocally answers the request from local_zones and local_records.
+// CNAME records pointing out of the local data are followed upstream.
+func (s *Server) answerLocally(req *DNSRequest) (answered bool, err error) {
+	question := &req.request.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return false, nil
+	}
+	data := s.filterLists().local
+	msg := newReply(req.request)
+	name := question.Name
+	seen := map[string]bool{}
+	for len(seen) <= localMaxCNAMEs {
+		a, ok := data.lookup(name, question.Qtype)
+		if !ok {
+			break
+		}
+		seen[strings.ToLower(name)] = true
+		req.response = msg
+		req.currentUpstream = "local"
+		msg.Rcode = a.rcode
+		msg.Authoritative = a.authoritative
+		msg.Answer = append(msg.Answer, a.answer...)
+		if a.soa != nil {
+			msg.Ns = []dns.RR{a.soa}
+		}
+		if len(a.answer) == 0 || question.Qtype == dns.TypeCNAME {
+			return true, nil
+		}
+		cname, ok := a.answer[0].(*dns.CNAME)
+		if !ok || seen[strings.ToLower(cname.Target)] {
+			return true, nil
+		}
+		name = cname.Target
+	}
+	if len(seen) == 0 {
+		return false, nil
+	}
+	// Restricted targets are blocked with the whole answer, see postLookup
+	if len(seen) > localMaxCNAMEs || s.isRestricted(name, req) {
+		return true, nil
+	}
+
+	// The target is not local, ask upstreams about it
+	chase := &DNSRequest{request: req.request.Copy(), profile: req.profile}
+	chase.request.Question[0].Name = name
+	chase, err = s.doDNSQuery(chase)
+	req.currentUpstream = chase.currentUpstream
+	if err != nil {
+		return true, err
+	}
+	msg.Rcode = chase.response.Rcode
+	msg.Authoritative = false
+	msg.Answer = append(msg.Answer, chase.response.Answer...)
+	return true, nil
+}
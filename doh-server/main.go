@@ -26,6 +26,9 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -44,8 +47,43 @@ func main() {
 	}
 
 	server := NewServer(conf)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	shutdown := make(chan error, 1)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGHUP {
+				log.Print("Reloading the configuration")
+				conf, err := loadConfig(*confPath)
+				if err == nil {
+					if *verbose {
+						conf.Verbose = true
+					}
+					err = server.Reload(conf)
+				}
+				if err != nil {
+					log.Printf("[Warning] Unable to reload configuration, keeping the old one: %v", err)
+				}
+				server.ReopenLogs()
+				continue
+			}
+			log.Printf("Received %v, shutting down", sig)
+			signal.Stop(signals)
+			shutdown <- server.Shutdown()
+			return
+		}
+	}()
+
 	err = server.Start()
 	if err != nil {
 		log.Fatalf("Can't start server: %v", err)
 	}
+	// Start only returns without an error after Shutdown closed the listeners
+	err = <-shutdown
+	if err != nil {
+		log.Printf("Unclean shutdown: %v", err)
+		os.Exit(1)
+	}
+	log.Print("Stopped")
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upper bounds of the upstream latency histogram buckets in seconds
+var upstreamLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics collects counters exposed in the Prometheus text format.
+// Gauges are read from the server when they are scraped.
+type metrics struct {
+	mu               sync.Mutex
+	requests         map[string]uint64
+	responses        map[string]uint64
+	blocked          map[string]uint64
+	upstreamErrors   map[string]uint64
+	upstreamLatency  map[string]*histogram
+	listsReloadTime  time.Time
+	listsReloadError uint64
+	// Updated atomically
+	staleAnswers uint64
+	prefetches   uint64
+	coalesced    uint64
+	localAnswers uint64
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:        map[string]uint64{},
+		responses:       map[string]uint64{},
+		blocked:         map[string]uint64{},
+		upstreamErrors:  map[string]uint64{},
+		upstreamLatency: map[string]*histogram{},
+	}
+}
+
+// labels formats label pairs, escaping the values
+func labels(pairs ...string) string {
+	escaper := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"=\""+escaper.Replace(pairs[i+1])+"\"")
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *metrics) countRequest(format, method string) {
+	// Clients choose the method, so other ones share a series
+	if method != "GET" && method != "POST" {
+		method = "other"
+	}
+	m.mu.Lock()
+	m.requests[labels("format", format, "method", method)]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) countResponse(qtype uint16, rcode int) {
+	m.mu.Lock()
+	m.responses[labels("qtype", qtypeName(qtype), "rcode", rcodeName(rcode))]++
+	m.mu.Unlock()
+}
+
+func qtypeName(qtype uint16) string {
+	if name, ok := dns.TypeToString[qtype]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+func rcodeName(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return strconv.Itoa(rcode)
+}
+
+// countBlocked counts a query blocked by list, which is "blacklist",
+// "category", "profile" or "overlay"; name is the category or profile ID
+func (m *metrics) countBlocked(list, name string) {
+	m.mu.Lock()
+	m.blocked[labels("list", list, "name", name)]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeUpstream(address string, rtt time.Duration, err error) {
+	key := labels("upstream", address)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.upstreamErrors[key]++
+		return
+	}
+	h := m.upstreamLatency[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(upstreamLatencyBuckets))}
+		m.upstreamLatency[key] = h
+	}
+	seconds := rtt.Seconds()
+	for i, bound := range upstreamLatencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *metrics) listsReloaded(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.listsReloadError++
+		return
+	}
+	m.listsReloadTime = time.Now()
+}
+
+// metricsWriter writes metric families in the Prometheus text format
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (w *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (w *metricsWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+func (w *metricsWriter) counters(name, help string, values map[string]uint64) {
+	w.family(name, "counter", help)
+	for _, key := range sortedKeys(values) {
+		w.sample(name, key, float64(values[key]))
+	}
+}
+
+func sortedKeys(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	out := &metricsWriter{}
+	m := s.metrics
+
+	m.mu.Lock()
+	out.counters("doh_requests_total", "DNS-over-HTTPS requests by format and HTTP method.", m.requests)
+	out.counters("doh_responses_total", "DNS responses by query type and response code.", m.responses)
+	out.counters("doh_blocked_queries_total", "Blocked queries by the list which restricted them.", m.blocked)
+	out.counters("doh_upstream_errors_total", "Failed upstream exchanges.", m.upstreamErrors)
+
+	out.family("doh_upstream_latency_seconds", "histogram", "Latency of successful upstream exchanges.")
+	keys := make([]string, 0, len(m.upstreamLatency))
+	for key := range m.upstreamLatency {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := m.upstreamLatency[key]
+		for i, bound := range upstreamLatencyBuckets {
+			out.sample("doh_upstream_latency_seconds_bucket", key+","+labels("le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(h.counts[i]))
+		}
+		out.sample("doh_upstream_latency_seconds_bucket", key+","+labels("le", "+Inf"), float64(h.count))
+		out.sample("doh_upstream_latency_seconds_sum", key, h.sum)
+		out.sample("doh_upstream_latency_seconds_count", key, float64(h.count))
+	}
+
+	out.family("doh_upstream_coalesced_queries_total", "counter", "Queries which shared the upstream exchange of an identical query in flight.")
+	out.sample("doh_upstream_coalesced_queries_total", "", float64(atomic.LoadUint64(&m.coalesced)))
+
+	out.family("doh_cache_stale_answers_total", "counter", "Expired cached responses served because upstreams failed.")
+	out.sample("doh_cache_stale_answers_total", "", float64(atomic.LoadUint64(&m.staleAnswers)))
+	out.family("doh_cache_prefetches_total", "counter", "Popular cached responses refreshed before they expired.")
+	out.sample("doh_cache_prefetches_total", "", float64(atomic.LoadUint64(&m.prefetches)))
+
+	out.family("doh_local_answers_total", "counter", "Questions answered from local_zones and local_records.")
+	out.sample("doh_local_answers_total", "", float64(atomic.LoadUint64(&m.localAnswers)))
+
+	out.family("doh_lists_reload_errors_total", "counter", "Failed filtering list reloads.")
+	out.sample("doh_lists_reload_errors_total", "", float64(m.listsReloadError))
+	if !m.listsReloadTime.IsZero() {
+		out.family("doh_lists_last_reload_timestamp_seconds", "gauge", "Time of the last successful filtering list reload.")
+		out.sample("doh_lists_last_reload_timestamp_seconds", "", float64(m.listsReloadTime.Unix()))
+	}
+	m.mu.Unlock()
+
+	state := s.state()
+	out.family("doh_list_entries", "gauge", "Entries of the filtering lists in use.")
+	lists := s.filterLists()
+	out.sample("doh_list_entries", labels("list", "blacklist", "name", ""), float64(lists.blacklist.Len()))
+	out.sample("doh_list_entries", labels("list", "whitelist", "name", ""), float64(lists.whitelist.Len()))
+	for _, c := range state.categories {
+		out.sample("doh_list_entries", labels("list", "category", "name", c.name), float64(lists.categories[c.name].Len()))
+	}
+
+	if tracker := state.tracker; tracker != nil {
+		out.family("doh_tracker_queue_length", "gauge", "Requests waiting to be written to the requests log.")
+		out.sample("doh_tracker_queue_length", "", float64(len(tracker.entries)))
+		out.family("doh_tracker_dropped_entries_total", "counter", "Requests log entries dropped because the queue was full.")
+		out.sample("doh_tracker_dropped_entries_total", "", float64(tracker.Dropped()))
+	}
+
+	ids := make([]string, 0, len(state.profiles))
+	for id := range state.profiles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, counter := range []struct {
+		name  string
+		help  string
+		value func(stats *profileStats) *uint64
+	}{
+		{"doh_profile_queries_total", "Queries per profile.", func(stats *profileStats) *uint64 { return &stats.Queries }},
+		{"doh_profile_blocked_total", "Blocked queries per profile.", func(stats *profileStats) *uint64 { return &stats.Blocked }},
+		{"doh_profile_upstream_errors_total", "Queries per profile which failed upstream.", func(stats *profileStats) *uint64 { return &stats.UpstreamErrors }},
+		{"doh_profile_rate_limited_total", "Rate limited queries per profile.", func(stats *profileStats) *uint64 { return &stats.RateLimited }},
+	} {
+		out.family(counter.name, "counter", counter.help)
+		for _, id := range ids {
+			name := id
+			if name == "" {
+				name = defaultProfileName
+			}
+			out.sample(counter.name, labels("profile", name), float64(atomic.LoadUint64(counter.value(state.profiles[id].stats))))
+		}
+	}
+
+	for _, gauge := range []struct {
+		name  string
+		help  string
+		value func(u *upstream) float64
+	}{
+		{"doh_upstream_success_rate", "Smoothed share of successful exchanges per profile and upstream.", func(u *upstream) float64 {
+			successRate, _ := u.health()
+			return successRate
+		}},
+		{"doh_upstream_ejected", "Whether the upstream of a profile is ejected after failures.", func(u *upstream) float64 {
+			if _, ejected := u.health(); ejected {
+				return 1
+			}
+			return 0
+		}},
+	} {
+		out.family(gauge.name, "gauge", gauge.help)
+		for _, id := range ids {
+			name := id
+			if name == "" {
+				name = defaultProfileName
+			}
+			for _, u := range state.profiles[id].upstreams.upstreams {
+				out.sample(gauge.name, labels("profile", name, "upstream", u.address), gauge.value(u))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out.WriteTo(w)
+}
+
+func (s *Server) startAdminEndpoint() {
+	if s.conf.AdminListen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	// Counters of every profile as JSON
+	mux.HandleFunc("/profile-stats", s.serveProfileStats)
+	if s.adminTokens != nil {
+		s.handleAdminAPI(mux)
+	}
+	server := &http.Server{Addr: s.conf.AdminListen, Handler: mux}
+	if !s.listeners.addHTTP(server) {
+		return
+	}
+	go func() {
+		log.Printf("Starting admin endpoint at %s", s.conf.AdminListen)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Unable to start admin endpoint: %v", err)
+		}
+	}()
+}
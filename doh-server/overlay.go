@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions of overlay entries
+const (
+	OverlayAllow = "allow"
+	OverlayDeny  = "deny"
+)
+
+// overlayEntry is a rule added with the admin API
+type overlayEntry struct {
+	// "example.com", "*.example.com", "||example.com^" or "/regex/"
+	Rule    string     `json:"rule"`
+	Action  string     `json:"action"`
+	Comment string     `json:"comment,omitempty"`
+	AddedBy string     `json:"added_by,omitempty"`
+	Added   time.Time  `json:"added"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// regexpLimitError is returned by add if the entry exceeds
+// lists_max_regexps
+type regexpLimitError struct {
+	action string
+	max    int
+}
+
+func (e *regexpLimitError) Error() string {
+	return fmt.Sprintf("at most %d regular expressions are allowed as %s entries", e.max, e.action)
+}
+
+type overlayFile struct {
+	Entries []*overlayEntry `json:"entries"`
+}
+
+// overlayLists are built from the entries and never modified
+type overlayLists struct {
+	entries []*overlayEntry
+	allow   *domainList
+	deny    *domainList
+}
+
+// overlay keeps the entries of the admin API in lists_overlay, apart
+// from lists_directory, so they survive restarts and new list
+// generations. Expired entries are removed from the file.
+type overlay struct {
+	path       string
+	maxRegexps int
+	current    atomic.Value
+
+	// Serializes changes
+	mu     sync.Mutex
+	expiry *time.Timer
+}
+
+func newOverlay(path string, maxRegexps int) (*overlay, error) {
+	o := &overlay{path: path, maxRegexps: maxRegexps}
+	var file overlayFile
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &file)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range file.Entries {
+		if err := o.checkEntry(e); err != nil {
+			return nil, err
+		}
+	}
+	for _, action := range []string{OverlayAllow, OverlayDeny} {
+		if count := countRegexps(file.Entries, action); count > maxRegexps {
+			log.Printf("[Warning] %s has %d regular expressions as %s entries, only %d are used", path, count, action, maxRegexps)
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.store(file.Entries)
+	return o, nil
+}
+
+func (o *overlay) lists() *overlayLists {
+	return o.current.Load().(*overlayLists)
+}
+
+func (o *overlay) checkEntry(e *overlayEntry) error {
+	if e.Action != OverlayAllow && e.Action != OverlayDeny {
+		return fmt.Errorf("unknown action %q of %q", e.Action, e.Rule)
+	}
+	if strings.HasPrefix(e.Rule, "@@") || strings.ContainsAny(e.Rule, " \t") {
+		return fmt.Errorf("invalid rule %q", e.Rule)
+	}
+	stats := listStats{}
+	newDomainList().parseLine(e.Rule, ListFormatAuto, o.maxRegexps, &stats)
+	if stats.accepted != 1 {
+		return fmt.Errorf("invalid rule %q", e.Rule)
+	}
+	return nil
+}
+
+// add adds the entry, replacing one with the same rule and action.
+// Regular expressions beyond lists_max_regexps are refused with a
+// *regexpLimitError.
+func (o *overlay) add(e *overlayEntry) error {
+	if !strings.HasPrefix(e.Rule, "/") {
+		e.Rule = strings.ToLower(e.Rule)
+	}
+	if err := o.checkEntry(e); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries := []*overlayEntry{e}
+	for _, old := range o.lists().entries {
+		if old.Rule != e.Rule || old.Action != e.Action {
+			entries = append(entries, old)
+		}
+	}
+	if strings.HasPrefix(e.Rule, "/") && countRegexps(o.unexpired(entries), e.Action) > o.maxRegexps {
+		return &regexpLimitError{action: e.Action, max: o.maxRegexps}
+	}
+	return o.save(entries)
+}
+
+// remove removes the entries with the rule and the action, or with
+// either action if it is empty. It returns the number of removed entries.
+func (o *overlay) remove(rule, action string) (int, error) {
+	if !strings.HasPrefix(rule, "/") {
+		rule = strings.ToLower(rule)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	old := o.lists().entries
+	entries := make([]*overlayEntry, 0, len(old))
+	for _, e := range old {
+		if e.Rule != rule || (action != "" && e.Action != action) {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == len(old) {
+		return 0, nil
+	}
+	return len(old) - len(entries), o.save(entries)
+}
+
+// save writes the entries to the file and uses them if that succeeded.
+// It must be called with o.mu held.
+func (o *overlay) save(entries []*overlayEntry) error {
+	entries = o.unexpired(entries)
+	data, err := json.MarshalIndent(overlayFile{Entries: entries}, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Replace the file atomically, so it's never seen half-written
+	temp, err := ioutil.TempFile(filepath.Dir(o.path), "."+filepath.Base(o.path))
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(append(data, '\n'))
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), o.path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	o.store(entries)
+	return nil
+}
+
+// store builds the lists of the unexpired entries and schedules removal
+// of the next one to expire. It must be called with o.mu held.
+func (o *overlay) store(entries []*overlayEntry) {
+	entries = o.unexpired(entries)
+	lists := &overlayLists{
+		entries: entries,
+		allow:   newDomainList(),
+		deny:    newDomainList(),
+	}
+	var next time.Time
+	for _, e := range entries {
+		list := lists.allow
+		if e.Action == OverlayDeny {
+			list = lists.deny
+		}
+		list.parseLine(e.Rule, ListFormatAuto, o.maxRegexps, &listStats{})
+		if e.Expires != nil && (next.IsZero() || e.Expires.Before(next)) {
+			next = *e.Expires
+		}
+	}
+	lists.allow.freeze(&listStats{})
+	lists.deny.freeze(&listStats{})
+	o.current.Store(lists)
+
+	if o.expiry != nil {
+		o.expiry.Stop()
+		o.expiry = nil
+	}
+	if !next.IsZero() {
+		o.expiry = time.AfterFunc(time.Until(next), o.removeExpired)
+	}
+}
+
+func (o *overlay) removeExpired() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries := o.lists().entries
+	if err := o.save(entries); err != nil {
+		// Expired entries are ignored anyway, only the file is outdated
+		log.Printf("[Warning] Unable to save %s: %v", o.path, err)
+		o.store(entries)
+	}
+}
+
+func countRegexps(entries []*overlayEntry, action string) int {
+	count := 0
+	for _, e := range entries {
+		if e.Action == action && strings.HasPrefix(e.Rule, "/") {
+			count++
+		}
+	}
+	return count
+}
+
+// unexpired returns the entries which haven't expired, sorted by rule
+func (o *overlay) unexpired(entries []*overlayEntry) []*overlayEntry {
+	now := time.Now()
+	result := make([]*overlayEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Expires == nil || e.Expires.After(now) {
+			result = append(result, e)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Rule != result[j].Rule {
+			return result[i].Rule < result[j].Rule
+		}
+		return result[i].Action < result[j].Action
+	})
+	return result
+}
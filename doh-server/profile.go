@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var profileIDRE = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Name of the default profile in statistics
+const defaultProfileName = "default"
+
+type profileConfig struct {
+	ID         string   `toml:"id"`
+	Categories []string `toml:"categories"`
+	Allow      []string `toml:"allow"`
+	Deny       []string `toml:"deny"`
+	BlockMode  string   `toml:"block_mode"`
+	Upstream   []string `toml:"upstream"`
+}
+
+// profile is a filtering setup served at "{path}/{id}". Requests to the
+// bare path use the default profile, which has an empty ID and consists
+// of the global settings only.
+type profile struct {
+	id string
+	// Categories enabled for every request in addition to requested ones
+	categories uint64
+	allow      *domainList
+	deny       *domainList
+	blockMode  string
+	upstreams  *upstreamPool
+	// Profiles with their own upstreams don't share cached answers
+	cachePartition string
+	// Kept across configuration reloads
+	stats *profileStats
+}
+
+type profileStats struct {
+	Queries        uint64 `json:"queries"`
+	Blocked        uint64 `json:"blocked"`
+	UpstreamErrors uint64 `json:"upstream_errors"`
+	RateLimited    uint64 `json:"rate_limited"`
+}
+
+func newProfile(pc profileConfig, conf *config, categories []*category) (*profile, error) {
+	if !profileIDRE.MatchString(pc.ID) || pc.ID == defaultProfileName {
+		return nil, fmt.Errorf("invalid profile id %q", pc.ID)
+	}
+	p := &profile{
+		id:        pc.ID,
+		allow:     newDomainList(),
+		deny:      newDomainList(),
+		blockMode: pc.BlockMode,
+		stats:     &profileStats{},
+	}
+	for _, name := range pc.Categories {
+		found := false
+		for _, c := range categories {
+			if c.name == name {
+				p.categories |= c.mask
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("profile %q: unknown category %q", pc.ID, name)
+		}
+	}
+	for _, rules := range []struct {
+		list    *domainList
+		entries []string
+	}{{p.allow, pc.Allow}, {p.deny, pc.Deny}} {
+		for _, entry := range rules.entries {
+			stats := listStats{}
+			rules.list.parseLine(strings.TrimSpace(entry), ListFormatAuto, conf.ListsMaxRegexps, &stats)
+			if stats.accepted == 0 {
+				return nil, fmt.Errorf("profile %q: invalid entry %q", pc.ID, entry)
+			}
+		}
+		rules.list.freeze(&listStats{})
+	}
+	if p.blockMode == "" {
+		p.blockMode = conf.BlockMode
+	} else if err := checkBlockMode(p.blockMode); err != nil {
+		return nil, fmt.Errorf("profile %q: %v", pc.ID, err)
+	}
+	for _, address := range pc.Upstream {
+		if _, err := parseUpstream(address); err != nil {
+			return nil, fmt.Errorf("profile %q: %v", pc.ID, err)
+		}
+	}
+	return p, nil
+}
+
+// newProfiles builds the configured profiles and the default one.
+// Upstream pools are left to the caller.
+func newProfiles(conf *config, categories []*category) (map[string]*profile, error) {
+	profiles := map[string]*profile{
+		"": {
+			allow:     newDomainList(),
+			deny:      newDomainList(),
+			blockMode: conf.BlockMode,
+			stats:     &profileStats{},
+		},
+	}
+	for _, pc := range conf.Profiles {
+		p, err := newProfile(pc, conf, categories)
+		if err != nil {
+			return nil, err
+		}
+		if profiles[p.id] != nil {
+			return nil, fmt.Errorf("profile %q is defined more than once", p.id)
+		}
+		profiles[p.id] = p
+	}
+	return profiles, nil
+}
+
+// findProfile parses "{path}[/{profile-id}[/{token}]]" and returns the
+// selected profile and the token, or nil if there is no such profile.
+// The default profile is selected as "default" when a token follows.
+// Tokens are only accepted in the path when auth_tokens is set.
+func (s *Server) findProfile(r *http.Request) (p *profile, token string) {
+	profiles := s.state().profiles
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, s.conf.Path), "/")
+	if rest == "" {
+		return profiles[""], ""
+	}
+	segments := strings.Split(rest, "/")
+	id := segments[0]
+	if id == defaultProfileName {
+		id = ""
+	}
+	switch {
+	case len(segments) == 1:
+		return profiles[id], ""
+	case len(segments) == 2 && s.conf.AuthTokens != "":
+		return profiles[id], segments[1]
+	}
+	return nil, ""
+}
+
+func (s *Server) serveProfileStats(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]profileStats{}
+	for id, p := range s.state().profiles {
+		if id == "" {
+			id = defaultProfileName
+		}
+		stats[id] = profileStats{
+			Queries:        atomic.LoadUint64(&p.stats.Queries),
+			Blocked:        atomic.LoadUint64(&p.stats.Blocked),
+			UpstreamErrors: atomic.LoadUint64(&p.stats.UpstreamErrors),
+			RateLimited:    atomic.LoadUint64(&p.stats.RateLimited),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+// rateLimiter keeps a token bucket per client. Buckets of the least
+// recently seen clients are evicted, which only makes those clients
+// start over with a full bucket.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	// Forwarding headers are only believed from these addresses
+	trustedProxies []*net.IPNet
+	// IPv6 clients are told apart by this prefix, as a host can
+	// usually pick any address of its /64
+	ipv6Mask net.IPMask
+
+	mu      sync.Mutex
+	buckets *lru.Cache
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate uint, burst uint, clients int, trustedProxies []string, ipv6Prefix int) (*rateLimiter, error) {
+	buckets, err := lru.New(clients)
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimiter{
+		rate:           float64(rate),
+		burst:          float64(burst),
+		trustedProxies: proxies,
+		ipv6Mask:       net.CIDRMask(ipv6Prefix, 8*net.IPv6len),
+		buckets:        buckets,
+	}, nil
+}
+
+// parseTrustedProxies accepts addresses and CIDR ranges
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, proxy := range proxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func (l *rateLimiter) isTrustedProxy(ip net.IP) bool {
+	for _, network := range l.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressKey returns the key of an anonymous client address
+func (l *rateLimiter) addressKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	prefix, _ := l.ipv6Mask.Size()
+	return fmt.Sprintf("%s/%d", ip.Mask(l.ipv6Mask), prefix)
+}
+
+// allow takes a token from the bucket of the client, if there is one
+func (l *rateLimiter) allow(client string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var bucket *tokenBucket
+	if value, ok := l.buckets.Get(client); ok {
+		bucket = value.(*tokenBucket)
+		bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+		if bucket.tokens > l.burst {
+			bucket.tokens = l.burst
+		}
+		bucket.last = now
+	} else {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets.Add(client, bucket)
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// rateLimitKey identifies the client by the name of its credentials,
+// or by its address for anonymous clients, see addressKey. Forwarding headers can be
+// made up by anyone, so they are only used behind a trusted proxy.
+func (s *Server) rateLimitKey(r *http.Request, client string) string {
+	if client != "" {
+		return "client " + client
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if !s.limiter.isTrustedProxy(ip) {
+		return s.limiter.addressKey(ip)
+	}
+	// Every proxy appends the address it got the request from, so the
+	// last address which isn't a trusted proxy is the client
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		addresses := strings.Split(forwardedFor, ",")
+		for i := len(addresses) - 1; i >= 0; i-- {
+			forwarded := net.ParseIP(strings.TrimSpace(addresses[i]))
+			if forwarded == nil {
+				break
+			}
+			ip = forwarded
+			if !s.limiter.isTrustedProxy(ip) {
+				break
+			}
+		}
+		return s.limiter.addressKey(ip)
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return s.limiter.addressKey(realIP)
+	}
+	return s.limiter.addressKey(ip)
+}
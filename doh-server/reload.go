@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// serverState is everything that is replaced at once when the
+// configuration is reloaded. It must not be modified after it has been
+// stored in Server.current.
+type serverState struct {
+	conf       *config
+	udpClient  *dns.Client
+	tcpClient  *dns.Client
+	upstreams  *upstreamPool
+	categories []*category
+	// Profiles by ID, the default one has an empty ID
+	profiles map[string]*profile
+	tracker  *Tracker
+}
+
+// Settings which are only applied on restart
+var restartSettings = []struct {
+	name  string
+	value func(conf *config) interface{}
+}{
+	{"listen", func(conf *config) interface{} { return conf.Listen }},
+	{"cert", func(conf *config) interface{} { return conf.Cert }},
+	{"key", func(conf *config) interface{} { return conf.Key }},
+	{"no_quic", func(conf *config) interface{} { return conf.NoQUIC }},
+	{"no_tcp_tls", func(conf *config) interface{} { return conf.NoTCPTLS }},
+	{"path", func(conf *config) interface{} { return conf.Path }},
+	{"auth_tokens", func(conf *config) interface{} { return conf.AuthTokens }},
+	{"auth_client_ca", func(conf *config) interface{} { return conf.AuthClientCA }},
+	{"rate_limit", func(conf *config) interface{} { return conf.RateLimit }},
+	{"rate_limit_burst", func(conf *config) interface{} { return conf.RateLimitBurst }},
+	{"rate_limit_clients", func(conf *config) interface{} { return conf.RateLimitClients }},
+	{"rate_limit_trusted_proxies", func(conf *config) interface{} { return conf.RateLimitProxies }},
+	{"rate_limit_ipv6_prefix", func(conf *config) interface{} { return conf.RateLimitIPv6Prefix }},
+	{"cache_size", func(conf *config) interface{} { return conf.CacheSize }},
+	{"cache_min_ttl", func(conf *config) interface{} { return conf.CacheMinTTL }},
+	{"cache_max_ttl", func(conf *config) interface{} { return conf.CacheMaxTTL }},
+	{"cache_stale_ttl", func(conf *config) interface{} { return conf.CacheStaleTTL }},
+	{"cache_stale_answer_ttl", func(conf *config) interface{} { return conf.CacheStaleAnswerTTL }},
+	{"cache_prefetch", func(conf *config) interface{} { return conf.CachePrefetch }},
+	{"lists_update_endpoint", func(conf *config) interface{} { return conf.ListsUpdateEndpoint }},
+	{"admin_listen", func(conf *config) interface{} { return conf.AdminListen }},
+	{"admin_tokens", func(conf *config) interface{} { return conf.AdminTokens }},
+	{"lists_overlay", func(conf *config) interface{} { return conf.ListsOverlay }},
+}
+
+func (s *Server) state() *serverState {
+	return s.current.Load().(*serverState)
+}
+
+// newServerState builds the state for a validated configuration.
+// Upstream pools of old with the same settings are kept along with the
+// health of their upstreams, and so are the statistics of profiles.
+func (s *Server) newServerState(conf *config, old *serverState) *serverState {
+	state := &serverState{
+		conf: conf,
+		udpClient: &dns.Client{
+			Net:     "udp",
+			UDPSize: dns.DefaultMsgSize,
+			Timeout: time.Duration(conf.Timeout) * time.Second,
+		},
+		tcpClient: &dns.Client{
+			Net:     "tcp",
+			Timeout: time.Duration(conf.Timeout) * time.Second,
+		},
+	}
+	oldPools := map[string]*upstreamPool{}
+	if old != nil {
+		state.tracker = old.tracker
+		for _, p := range old.profiles {
+			oldPools[p.upstreams.key()] = p.upstreams
+		}
+	}
+	pool := func(addresses []string) *upstreamPool {
+		p := newUpstreamPool(addresses, conf, s.exchange)
+		if oldPool := oldPools[p.key()]; oldPool != nil {
+			return oldPool
+		}
+		oldPools[p.key()] = p
+		return p
+	}
+
+	// Categories and profiles are already validated by loadConfig
+	state.categories, _ = newCategories(conf.Categories)
+	state.upstreams = pool(conf.Upstream)
+	state.profiles, _ = newProfiles(conf, state.categories)
+	state.profiles[""].upstreams = state.upstreams
+	for _, pc := range conf.Profiles {
+		p := state.profiles[pc.ID]
+		if len(pc.Upstream) == 0 {
+			p.upstreams = state.upstreams
+			continue
+		}
+		p.upstreams = pool(pc.Upstream)
+		p.cachePartition = p.id
+	}
+	if old != nil {
+		for id, p := range state.profiles {
+			if oldProfile := old.profiles[id]; oldProfile != nil {
+				p.stats = oldProfile.stats
+			}
+		}
+	}
+	return state
+}
+
+// Reload applies a new configuration loaded by loadConfig, except for
+// settings which need a restart. The old configuration stays in effect
+// if the lists or the requests log of the new one can't be loaded.
+func (s *Server) Reload(conf *config) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	old := s.state()
+	for _, setting := range restartSettings {
+		if !reflect.DeepEqual(setting.value(s.conf), setting.value(conf)) {
+			log.Printf("[Warning] Changed %s needs a restart to take effect", setting.name)
+		}
+	}
+
+	state := s.newServerState(conf, old)
+	lists, err := s.loadLists(state)
+	if err != nil {
+		state.closeUnusedPools(old)
+		return err
+	}
+
+	trackerConf := newTrackerConfig(conf)
+	if conf.RequestsLog == "" {
+		state.tracker = nil
+	} else if old.tracker == nil || !reflect.DeepEqual(old.tracker.conf, trackerConf) {
+		state.tracker, err = NewTracker(trackerConf)
+		if err != nil {
+			state.closeUnusedPools(old)
+			return fmt.Errorf("can't open requests log: %v", err)
+		}
+		state.tracker.Start()
+	}
+
+	s.current.Store(state)
+	s.setLists(lists)
+	old.closeUnusedPools(state)
+	if old.tracker != nil && old.tracker != state.tracker {
+		old.tracker.Close()
+	}
+	log.Print("Configuration is reloaded")
+	return nil
+}
+
+// closeUnusedPools stops probing upstreams of pools which are not
+// used by other
+func (state *serverState) closeUnusedPools(other *serverState) {
+	used := map[*upstreamPool]bool{}
+	for _, p := range other.profiles {
+		used[p.upstreams] = true
+	}
+	for _, p := range state.profiles {
+		if !used[p.upstreams] {
+			p.upstreams.close()
+		}
+	}
+}
@@ -24,14 +24,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ProfitLabs/quic-dns/json-dns"
@@ -41,15 +43,26 @@ import (
 )
 
 type Server struct {
-	conf      *config
-	udpClient *dns.Client
-	tcpClient *dns.Client
-	servemux  *http.ServeMux
-	listsMu   sync.RWMutex
-	whitelist map[string]bool
-	blacklist map[string]bool
-	adsList   map[string]bool
-	tracker   *Tracker
+	// Configuration at startup, see state() for the current one
+	conf     *config
+	current  atomic.Value
+	lists    atomic.Value
+	servemux *http.ServeMux
+	cache    *ResponseCache
+
+	// Nil if clients are not authenticated
+	auth *authenticator
+	// Nil if lists_overlay is not set
+	overlay *overlay
+	// Nil if the admin API is disabled
+	adminTokens *authenticator
+	// Nil if rate limiting is disabled
+	limiter   *rateLimiter
+	metrics   *metrics
+	listeners listeners
+	inflight  singleflight
+	// Serializes loading of lists and configuration reloads
+	reloadMu sync.Mutex
 }
 
 type DNSRequest struct {
@@ -62,26 +75,26 @@ type DNSRequest struct {
 	errtext          string
 	filterCategories uint64
 	dnt              bool
+	blocked          bool
+	blockedName      string
+	profile          *profile
+	// Name of the authenticated client
+	client string
+	// Kind and name of the list which restricted blockedName
+	blockedList     string
+	blockedListName string
 }
 
 func NewServer(conf *config) (s *Server) {
 	s = &Server{
-		conf: conf,
-		udpClient: &dns.Client{
-			Net:     "udp",
-			UDPSize: dns.DefaultMsgSize,
-			Timeout: time.Duration(conf.Timeout) * time.Second,
-		},
-		tcpClient: &dns.Client{
-			Net:     "tcp",
-			Timeout: time.Duration(conf.Timeout) * time.Second,
-		},
-		servemux:  http.NewServeMux(),
-		whitelist: map[string]bool{},
-		blacklist: map[string]bool{},
-		adsList:   map[string]bool{},
+		conf:     conf,
+		servemux: http.NewServeMux(),
+		metrics:  newMetrics(),
 	}
+	s.current.Store(s.newServerState(conf, nil))
+	s.setLists(newFilterLists())
 	s.servemux.HandleFunc(conf.Path, s.handlerFunc)
+	s.servemux.HandleFunc(strings.TrimSuffix(conf.Path, "/")+"/", s.handlerFunc)
 	return
 }
 
@@ -91,40 +104,147 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	if s.conf.CacheSize > 0 {
+		cache, err := NewResponseCache(newCacheConfig(s.conf))
+		if err != nil {
+			return err
+		}
+		s.cache = cache
+	}
+
+	if s.conf.AuthTokens != "" || s.conf.AuthClientCA != "" {
+		s.auth, err = newAuthenticator(s.conf.AuthTokens)
+		if err != nil {
+			return fmt.Errorf("can't read auth tokens: %v", err)
+		}
+	}
+
+	if s.conf.ListsOverlay != "" {
+		s.overlay, err = newOverlay(s.conf.ListsOverlay, s.conf.ListsMaxRegexps)
+		if err != nil {
+			return fmt.Errorf("can't read lists overlay: %v", err)
+		}
+		log.Printf("Lists overlay entries: %d", len(s.overlay.lists().entries))
+	}
+	if s.conf.AdminTokens != "" {
+		s.adminTokens, err = newAuthenticator(s.conf.AdminTokens)
+		if err != nil {
+			return fmt.Errorf("can't read admin tokens: %v", err)
+		}
+	}
+
+	if s.conf.RateLimit > 0 {
+		s.limiter, err = newRateLimiter(s.conf.RateLimit, s.conf.RateLimitBurst, s.conf.RateLimitClients, s.conf.RateLimitProxies, s.conf.RateLimitIPv6Prefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	go s.watchLists()
+
 	err = s.startListsUpdateEndpoint()
 	if err != nil {
 		return err
 	}
+	s.startAdminEndpoint()
 
 	if s.conf.RequestsLog != "" {
-		tracker, err := NewTracker(s.conf.RequestsLog)
+		tracker, err := NewTracker(newTrackerConfig(s.conf))
 		if err != nil {
 			return err
 		}
-		s.tracker = tracker
-		s.tracker.Start()
+		tracker.Start()
+		state := *s.state()
+		state.tracker = tracker
+		s.current.Store(&state)
 	}
 
-	servemux := http.Handler(s.servemux)
-	if s.conf.Verbose {
-		servemux = handlers.CombinedLoggingHandler(os.Stdout, servemux)
+	servemux := s.verboseHandler(s.drainHandler(s.servemux))
+	useTLS := s.conf.Cert != "" || s.conf.Key != ""
+	var tlsConfig *tls.Config
+	if useTLS {
+		cert, err := tls.LoadX509KeyPair(s.conf.Cert, s.conf.Key)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+	tcpTLSConfig := tlsConfig
+	if s.conf.AuthClientCA != "" {
+		clientCAs, err := loadClientCA(s.conf.AuthClientCA)
+		if err != nil {
+			return fmt.Errorf("can't read client CA: %v", err)
+		}
+		// Clients may authenticate with a token instead
+		tcpTLSConfig = tlsConfig.Clone()
+		tcpTLSConfig.ClientCAs = clientCAs
+		tcpTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	numListeners := len(s.conf.Listen)
+	if useTLS && !s.conf.NoQUIC && !s.conf.NoTCPTLS {
+		numListeners *= 2
+	}
+	results := make(chan error, numListeners)
+	serve := func(addr string, description string, listen func() error) {
+		log.Printf("Starting %s at %s", description, addr)
+		err := listen()
+		if s.listeners.isStopping() {
+			// Closed by Shutdown
+			err = nil
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		results <- err
 	}
-	results := make(chan error, len(s.conf.Listen))
 	for _, addr := range s.conf.Listen {
-		go func(addr string) {
-			var err error
-			if s.conf.Cert != "" || s.conf.Key != "" {
-				log.Printf("Starting QUIC + HTTPS at %s", addr)
-				err = h2quic.ListenAndServe(addr, s.conf.Cert, s.conf.Key, servemux)
-			} else {
-				log.Printf("Starting HTTP at %s", addr)
-				err = http.ListenAndServe(addr, servemux)
+		if !useTLS {
+			httpServer := &http.Server{
+				Addr:    addr,
+				Handler: servemux,
 			}
-			if err != nil {
-				log.Println(err)
+			if !s.listeners.addHTTP(httpServer) {
+				return nil
+			}
+			go serve(addr, "HTTP", httpServer.ListenAndServe)
+			continue
+		}
+
+		var quicServer *h2quic.Server
+		if !s.conf.NoQUIC {
+			quicServer = &h2quic.Server{
+				Server: &http.Server{
+					Addr:      addr,
+					Handler:   servemux,
+					TLSConfig: tlsConfig.Clone(),
+				},
+			}
+			if !s.listeners.addQUIC(quicServer) {
+				return nil
+			}
+			go serve(addr, "QUIC", quicServer.ListenAndServe)
+		}
+		if !s.conf.NoTCPTLS {
+			handler := servemux
+			if quicServer != nil {
+				handler = altSvcHandler(quicServer, servemux)
 			}
-			results <- err
-		}(addr)
+			httpServer := &http.Server{
+				Addr:      addr,
+				Handler:   handler,
+				TLSConfig: tcpTLSConfig.Clone(),
+			}
+			if !s.listeners.addHTTP(httpServer) {
+				return nil
+			}
+			go serve(addr, "HTTPS", func() error {
+				return httpServer.ListenAndServeTLS("", "")
+			})
+		}
 	}
 	// wait for all handlers
 	for i := 0; i < cap(results); i++ {
@@ -137,10 +257,68 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// ReopenLogs reopens the requests log after it was rotated externally
+func (s *Server) ReopenLogs() {
+	if tracker := s.state().tracker; tracker != nil {
+		tracker.Reopen()
+	}
+}
+
+// CloseLogs writes out the buffered requests log
+func (s *Server) CloseLogs() {
+	if tracker := s.state().tracker; tracker != nil {
+		tracker.Close()
+	}
+}
+
+// verboseHandler logs requests while verbose is enabled
+func (s *Server) verboseHandler(handler http.Handler) http.Handler {
+	logged := handlers.CombinedLoggingHandler(os.Stdout, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.state().conf.Verbose {
+			logged.ServeHTTP(w, r)
+		} else {
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Advertise the QUIC listener on the same port to clients connected over
+// TCP. Clients with certificates are kept on TCP, as gQUIC can't
+// authenticate them.
+func altSvcHandler(quicServer *h2quic.Server, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			err := quicServer.SetQuicHeaders(w.Header())
+			if err != nil {
+				log.Printf("[Warning] Unable to set Alt-Svc header: %v", err)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", USER_AGENT)
 	w.Header().Set("X-Powered-By", USER_AGENT)
 
+	profile, pathToken := s.findProfile(r)
+	if profile == nil {
+		jsonDNS.FormatError(w, fmt.Sprintf("Unknown profile: %q", r.URL.Path), 404)
+		return
+	}
+	client := ""
+	if s.auth != nil {
+		var ok bool
+		client, ok = s.auth.authenticate(r, pathToken)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			jsonDNS.FormatError(w, "Authentication required", 401)
+			return
+		}
+	}
+	atomic.AddUint64(&profile.stats.Queries, 1)
+
 	if r.Form == nil {
 		const maxMemory = 32 << 20 // 32 MB
 		r.ParseMultipartForm(maxMemory)
@@ -193,6 +371,11 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		jsonDNS.FormatError(w, fmt.Sprintf("Invalid argument value: \"ct\" = %q", contentType), 415)
 		return
 	}
+	format := "wire"
+	if contentType == "application/dns-json" {
+		format = "json"
+	}
+	s.metrics.countRequest(format, r.Method)
 	if req.errcode == 444 {
 		return
 	}
@@ -201,6 +384,23 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.profile = profile
+	req.client = client
+
+	if s.limiter != nil && !s.limiter.allow(s.rateLimitKey(r, client)) {
+		atomic.AddUint64(&profile.stats.RateLimited, 1)
+		if responseType == "application/dns-message" {
+			req.response = new(dns.Msg)
+			req.response.SetRcode(req.request, dns.RcodeRefused)
+			s.generateResponseIETF(w, r, req)
+		} else {
+			w.Header().Set("Retry-After", "1")
+			jsonDNS.FormatError(w, "Rate limit exceeded", 429)
+		}
+		return
+	}
+
+	req.filterCategories |= profile.categories
 	req = s.patchRootRD(req)
 
 	s.preLookup(req)
@@ -208,18 +408,34 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 		jsonDNS.FormatError(w, req.errtext, req.errcode)
 		return
 	}
-	if s.tracker != nil && !req.dnt {
-		s.tracker.SaveDomain(req.request.Question[0].Name)
-	}
 
-	var err error
-	req, err = s.doDNSQuery(req)
-	if err != nil {
-		jsonDNS.FormatError(w, fmt.Sprintf("DNS query failure (%s)", err.Error()), 503)
-		return
-	}
+	start := time.Now()
+	if !req.blocked {
+		local, err := s.answerLocally(req)
+		if !local && err == nil {
+			req, err = s.doDNSQuery(req)
+		}
+		if err != nil {
+			atomic.AddUint64(&profile.stats.UpstreamErrors, 1)
+			s.trackRequest(r, req, format, rcodeName(dns.RcodeServerFailure), time.Since(start))
+			jsonDNS.FormatError(w, fmt.Sprintf("DNS query failure (%s)", err.Error()), 503)
+			return
+		}
 
-	s.postLookup(req)
+		if local {
+			// Keep the SOA record of negative local answers
+			atomic.AddUint64(&s.metrics.localAnswers, 1)
+			s.checkAnswer(req)
+		} else {
+			s.postLookup(req)
+		}
+	}
+	if req.blocked {
+		atomic.AddUint64(&profile.stats.Blocked, 1)
+		s.metrics.countBlocked(req.blockedList, req.blockedListName)
+	}
+	s.metrics.countResponse(req.request.Question[0].Qtype, req.response.Rcode)
+	s.trackRequest(r, req, format, rcodeName(req.response.Rcode), time.Since(start))
 
 	if responseType == "application/json" {
 		s.generateResponseGoogle(w, r, req)
@@ -230,6 +446,42 @@ func (s *Server) handlerFunc(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// trackRequest saves the query to the requests log unless the client
+// asked not to be tracked
+func (s *Server) trackRequest(r *http.Request, req *DNSRequest, format string, rcode string, latency time.Duration) {
+	tracker := s.state().tracker
+	if tracker == nil || req.dnt {
+		return
+	}
+	question := &req.request.Question[0]
+	entry := &trackerEntry{
+		date:        time.Now(),
+		name:        question.Name,
+		qtype:       qtypeName(question.Qtype),
+		rcode:       rcode,
+		format:      format,
+		upstream:    req.currentUpstream,
+		latency:     latency,
+		blocked:     req.blocked,
+		list:        req.blockedList,
+		listName:    req.blockedListName,
+		blockedName: req.blockedName,
+		profile:     req.profile.id,
+		client:      req.client,
+	}
+	if ip := s.findClientIP(r); ip != nil {
+		entry.clientIP = ip.String()
+	}
+	// A reload may have replaced and closed the tracker meanwhile
+	for !tracker.Save(entry) {
+		next := s.state().tracker
+		if next == nil || next == tracker {
+			return
+		}
+		tracker = next
+	}
+}
+
 func (s *Server) findClientIP(r *http.Request) net.IP {
 	XForwardedFor := r.Header.Get("X-Forwarded-For")
 	if XForwardedFor != "" {
@@ -270,22 +522,162 @@ func (s *Server) patchRootRD(req *DNSRequest) *DNSRequest {
 }
 
 func (s *Server) doDNSQuery(req *DNSRequest) (resp *DNSRequest, err error) {
-	numServers := len(s.conf.Upstream)
-	for i := uint(0); i < s.conf.Tries; i++ {
-		req.currentUpstream = s.conf.Upstream[rand.Intn(numServers)]
-		if !s.conf.TCPOnly {
-			req.response, _, err = s.udpClient.Exchange(req.request, req.currentUpstream)
-			if err == dns.ErrTruncated {
-				log.Println(err)
-				req.response, _, err = s.tcpClient.Exchange(req.request, req.currentUpstream)
+	partition := req.profile.cachePartition
+	if s.cache != nil {
+		if response, prefetch := s.cache.Get(partition, req.request); response != nil {
+			if prefetch {
+				go s.prefetch(req.profile, req.request.Copy())
 			}
-		} else {
-			req.response, _, err = s.tcpClient.Exchange(req.request, req.currentUpstream)
+			req.response = response
+			req.currentUpstream = "cache"
+			return req, nil
+		}
+	}
+
+	req.response, req.currentUpstream, err = s.coalescedQuery(req.profile, req.request)
+	if err == nil && !isFailureRcode(req.response.Rcode) {
+		if s.cache != nil {
+			s.cache.Store(partition, req.request, req.response)
 		}
-		if err == nil {
+		return req, nil
+	}
+	// Upstreams failed, couldn't resolve the name or refused it
+	if s.cache != nil {
+		if response := s.cache.GetStale(partition, req.request); response != nil {
+			atomic.AddUint64(&s.metrics.staleAnswers, 1)
+			req.response = response
+			req.currentUpstream = "stale"
 			return req, nil
 		}
-		log.Printf("DNS error from upstream %s: %s\n", req.currentUpstream, err.Error())
 	}
 	return req, err
 }
+
+// coalescedQuery shares one upstream exchange between concurrent
+// requests with the same question, see cacheKeys
+func (s *Server) coalescedQuery(p *profile, request *dns.Msg) (response *dns.Msg, address string, err error) {
+	key, _, ok := cacheKeys(p.cachePartition, request)
+	if !ok {
+		return s.queryUpstreams(p.upstreams, request)
+	}
+	response, address, err, coalesced := s.inflight.Do(key, func() (*dns.Msg, string, error) {
+		return s.queryUpstreams(p.upstreams, request)
+	})
+	if coalesced {
+		atomic.AddUint64(&s.metrics.coalesced, 1)
+		if response != nil {
+			response.Id = request.Id
+		}
+	}
+	return response, address, err
+}
+
+type upstreamResult struct {
+	upstream *upstream
+	response *dns.Msg
+	rtt      time.Duration
+	err      error
+}
+
+// queryUpstreams sends the request to upstreams of the pool until one
+// answers or tries runs out. upstream_parallel upstreams are queried at
+// once, and another one whenever upstream_hedge_delay passes without a
+// winner. The exchanges still running when an answer wins are cancelled.
+// Address is the upstream of the answer, or the last one which failed.
+func (s *Server) queryUpstreams(upstreams *upstreamPool, request *dns.Msg) (response *dns.Msg, address string, err error) {
+	conf := s.state().conf
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan upstreamResult, conf.Tries)
+	tried := map[*upstream]bool{}
+	started, pending := uint(0), 0
+	start := func() {
+		u := upstreams.pick(tried)
+		tried[u] = true
+		started++
+		pending++
+		go func() {
+			response, rtt, err := s.exchange(ctx, u, request)
+			results <- upstreamResult{u, response, rtt, err}
+		}()
+	}
+	for started < conf.UpstreamParallel {
+		start()
+	}
+	var hedge <-chan time.Time
+	if conf.UpstreamHedgeDelay != 0 && started < conf.Tries {
+		ticker := time.NewTicker(time.Duration(conf.UpstreamHedgeDelay) * time.Millisecond)
+		defer ticker.Stop()
+		hedge = ticker.C
+	}
+
+	// A SERVFAIL or REFUSED answer is only used if no other one arrives
+	var fallback *upstreamResult
+	for pending > 0 {
+		var result upstreamResult
+		select {
+		case result = <-results:
+		case <-hedge:
+			if started < conf.Tries {
+				start()
+			}
+			continue
+		}
+		pending--
+		u := result.upstream
+		s.metrics.observeUpstream(u.address, result.rtt, result.err)
+		if result.err != nil {
+			upstreams.reportFailure(u)
+			log.Printf("DNS error from upstream %s: %s\n", u.address, result.err.Error())
+			address, err = u.address, result.err
+			if pending == 0 && started < conf.Tries {
+				start()
+			}
+			continue
+		}
+		if isFailureRcode(result.response.Rcode) {
+			upstreams.reportFailure(u)
+			if fallback == nil {
+				fallback = &result
+			}
+			if pending == 0 && started < conf.Tries {
+				start()
+			}
+			continue
+		}
+		upstreams.reportSuccess(u, result.rtt)
+		return result.response, u.address, nil
+	}
+	if fallback != nil {
+		return fallback.response, fallback.upstream.address, nil
+	}
+	return nil, address, err
+}
+
+// prefetch refreshes a cached response in the background before it
+// expires
+func (s *Server) prefetch(p *profile, request *dns.Msg) {
+	response, _, err := s.queryUpstreams(p.upstreams, request)
+	if err != nil {
+		return
+	}
+	atomic.AddUint64(&s.metrics.prefetches, 1)
+	s.cache.Store(p.cachePartition, request, response)
+}
+
+func (s *Server) exchange(ctx context.Context, u *upstream, msg *dns.Msg) (response *dns.Msg, rtt time.Duration, err error) {
+	state := s.state()
+	if u.tlsConfig != nil {
+		return u.exchangeTLS(ctx, msg, time.Duration(state.conf.Timeout)*time.Second)
+	}
+	if !state.conf.TCPOnly {
+		response, rtt, err = exchangeContext(ctx, state.udpClient, msg, u.address)
+		if err == dns.ErrTruncated {
+			log.Println(err)
+			response, rtt, err = exchangeContext(ctx, state.tcpClient, msg, u.address)
+		}
+	} else {
+		response, rtt, err = exchangeContext(ctx, state.tcpClient, msg, u.address)
+	}
+	return
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ProfitLabs/quic-dns/json-dns"
+	"github.com/lucas-clemente/quic-go/h2quic"
+)
+
+// How often the number of in-flight requests is checked while draining
+const drainPollInterval = 50 * time.Millisecond
+
+// listeners keeps the servers which are stopped by Shutdown
+type listeners struct {
+	mu       sync.Mutex
+	stopping bool
+	http     []*http.Server
+	quic     []*h2quic.Server
+	// Requests being handled by the DNS handler
+	inflight int64
+}
+
+// addHTTP registers a server before it is started. It returns false if
+// the server must not be started because of a shutdown.
+func (l *listeners) addHTTP(server *http.Server) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.http = append(l.http, server)
+	return true
+}
+
+func (l *listeners) addQUIC(server *h2quic.Server) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.quic = append(l.quic, server)
+	return true
+}
+
+func (l *listeners) isStopping() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopping
+}
+
+// drainHandler counts in-flight requests and turns new ones away during
+// a shutdown. This is needed for QUIC, which can't be shut down
+// gracefully and would drop in-flight requests when closed.
+func (s *Server) drainHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.listeners.inflight, 1)
+		defer atomic.AddInt64(&s.listeners.inflight, -1)
+		if s.listeners.isStopping() {
+			w.Header().Set("Connection", "close")
+			jsonDNS.FormatError(w, "Server is shutting down", 503)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Shutdown stops accepting connections on every listener, waits for
+// in-flight requests for up to shutdown_timeout and writes out the
+// requests log. It returns an error if requests had to be aborted.
+func (s *Server) Shutdown() error {
+	timeout := time.Duration(s.state().conf.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	s.listeners.mu.Lock()
+	s.listeners.stopping = true
+	httpServers := s.listeners.http
+	quicServers := s.listeners.quic
+	s.listeners.mu.Unlock()
+
+	var result error
+	var resultMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, server := range httpServers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				resultMu.Lock()
+				result = err
+				resultMu.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	ticker := time.NewTicker(drainPollInterval)
+	for atomic.LoadInt64(&s.listeners.inflight) != 0 && result == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			result = errors.New("in-flight requests did not finish in time")
+		}
+	}
+	ticker.Stop()
+	for _, server := range quicServers {
+		if err := server.Close(); err != nil {
+			log.Printf("[Warning] Unable to close QUIC listener: %v", err)
+		}
+	}
+
+	s.CloseLogs()
+	return result
+}
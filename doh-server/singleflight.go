@@ -0,0 +1,72 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Adapted from the singleinflight helper of miekg/dns, which is not
+// exported, to carry the upstream address.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// call is an in-flight or completed singleflight.Do call
+type call struct {
+	wg       sync.WaitGroup
+	response *dns.Msg
+	address  string
+	err      error
+	dups     int
+}
+
+// singleflight represents a class of work and forms a namespace in
+// which units of work can be executed with duplicate suppression.
+type singleflight struct {
+	sync.Mutex                  // protects m
+	m          map[string]*call // lazily initialized
+}
+
+// Do executes and returns the results of the given function, making
+// sure that only one execution is in-flight for a given key at a
+// time. If a duplicate comes in, the duplicate caller waits for the
+// original to complete and receives the same results.
+// Every caller gets its own copy of the response. The return value
+// coalesced is true for the duplicate callers.
+func (g *singleflight) Do(key string, fn func() (*dns.Msg, string, error)) (response *dns.Msg, address string, err error, coalesced bool) {
+	g.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.Unlock()
+		c.wg.Wait()
+		return copyMsg(c.response), c.address, c.err, true
+	}
+	c := new(call)
+	c.wg.Add(1)
+	g.m[key] = c
+	g.Unlock()
+
+	c.response, c.address, c.err = fn()
+	c.wg.Done()
+
+	g.Lock()
+	delete(g.m, key)
+	g.Unlock()
+
+	if c.dups > 0 {
+		return copyMsg(c.response), c.address, c.err, false
+	}
+	return c.response, c.address, c.err, false
+}
+
+func copyMsg(msg *dns.Msg) *dns.Msg {
+	if msg == nil {
+		return nil
+	}
+	return msg.Copy()
+}
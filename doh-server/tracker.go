@@ -2,62 +2,352 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// trackerEntry is a line of the requests log, see "Query log" in Readme.md
 type trackerEntry struct {
-	domain string
-	date   time.Time
+	date        time.Time
+	name        string
+	qtype       string
+	rcode       string
+	format      string
+	upstream    string
+	latency     time.Duration
+	blocked     bool
+	list        string
+	listName    string
+	blockedName string
+	profile     string
+	client      string
+	clientIP    string
 }
 
+// Fields of the requests log. Existing fields must not change their
+// meaning, as the log is read by other programs.
+var trackerFields = map[string]func(e *trackerEntry) interface{}{
+	"time":         func(e *trackerEntry) interface{} { return e.date.UTC().Format("2006-01-02T15:04:05.000Z") },
+	"name":         func(e *trackerEntry) interface{} { return e.name },
+	"qtype":        func(e *trackerEntry) interface{} { return e.qtype },
+	"rcode":        func(e *trackerEntry) interface{} { return e.rcode },
+	"format":       func(e *trackerEntry) interface{} { return e.format },
+	"upstream":     func(e *trackerEntry) interface{} { return e.upstream },
+	"latency_ms":   func(e *trackerEntry) interface{} { return float64(e.latency/time.Microsecond) / 1000 },
+	"blocked":      func(e *trackerEntry) interface{} { return e.blocked },
+	"list":         func(e *trackerEntry) interface{} { return e.list },
+	"list_name":    func(e *trackerEntry) interface{} { return e.listName },
+	"blocked_name": func(e *trackerEntry) interface{} { return e.blockedName },
+	"profile":      func(e *trackerEntry) interface{} { return e.profile },
+	"client":       func(e *trackerEntry) interface{} { return e.client },
+	"client_ip":    func(e *trackerEntry) interface{} { return e.clientIP },
+}
+
+// Client identities are left out by default
+var defaultTrackerFields = []string{"time", "name", "qtype", "rcode", "format", "upstream", "latency_ms", "blocked", "list", "list_name", "profile"}
+
+func checkTrackerFields(fields []string) error {
+	for _, field := range fields {
+		if trackerFields[field] == nil {
+			return fmt.Errorf("unknown requests_log_fields entry %q", field)
+		}
+	}
+	return nil
+}
+
+// Policies for entries which don't fit into the requests log queue
+const (
+	TrackerQueueDrop  = "drop"
+	TrackerQueueBlock = "block"
+)
+
+// Suffix of rotated requests logs, which sorts in the order of rotation
+const trackerRotatedSuffix = ".2006-01-02T15-04-05.000"
+
+// Entries are written out once this much is buffered
+const trackerBufferSize = 64 << 10
+
+type trackerConfig struct {
+	path   string
+	fields []string
+	// Rotate after the file grows to maxSize bytes or gets older than
+	// maxAge, 0 disables the check
+	maxSize int64
+	maxAge  time.Duration
+	// Number of rotated files to keep, 0 keeps all of them
+	keep          int
+	compress      bool
+	flushInterval time.Duration
+	queueSize     int
+	queuePolicy   string
+}
+
+// Tracker writes the requests log in the background. Entries are
+// buffered and flushed to the file regularly, on rotation and on Close.
 type Tracker struct {
+	conf    trackerConfig
 	entries chan *trackerEntry
-	file    *os.File
+	reopen  chan struct{}
+	closing chan chan struct{}
+	dropped uint64
+	// Held by Save while queueing, so Close waits for it
+	closeMu sync.RWMutex
+	closed  bool
+
+	file   *os.File
+	size   int64
+	opened time.Time
+	// Serializes compression and removal of rotated files
+	cleanupMu sync.Mutex
 }
 
-func NewTracker(filepath string) (*Tracker, error) {
-	file, err := os.OpenFile(filepath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
+func newTrackerConfig(conf *config) trackerConfig {
+	return trackerConfig{
+		path:          conf.RequestsLog,
+		fields:        conf.RequestsLogFields,
+		maxSize:       int64(conf.RequestsLogMaxSize) << 20,
+		maxAge:        time.Duration(conf.RequestsLogMaxAge) * time.Second,
+		keep:          conf.RequestsLogKeep,
+		compress:      conf.RequestsLogCompress,
+		flushInterval: time.Duration(conf.RequestsLogFlush) * time.Second,
+		queueSize:     conf.RequestsLogQueue,
+		queuePolicy:   conf.RequestsLogPolicy,
+	}
+}
+
+func NewTracker(conf trackerConfig) (*Tracker, error) {
+	t := &Tracker{
+		conf:    conf,
+		entries: make(chan *trackerEntry, conf.queueSize),
+		reopen:  make(chan struct{}, 1),
+		closing: make(chan chan struct{}),
+	}
+	if err := t.open(); err != nil {
 		return nil, err
 	}
-	return &Tracker{make(chan *trackerEntry, 1000), file}, nil
+	return t, nil
 }
 
-func (t *Tracker) SaveDomain(domain string) {
-	t.entries <- &trackerEntry{
-		domain,
-		time.Now(),
+func (t *Tracker) open() error {
+	file, err := os.OpenFile(t.conf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.file = file
+	t.size = info.Size()
+	t.opened = time.Now()
+	return nil
+}
+
+// Save queues the entry. When the queue is full, the entry is dropped
+// or the caller waits, according to the queue policy. It returns false
+// if the tracker is closed already, then the entry counts as dropped.
+func (t *Tracker) Save(entry *trackerEntry) bool {
+	t.closeMu.RLock()
+	defer t.closeMu.RUnlock()
+	if t.closed {
+		atomic.AddUint64(&t.dropped, 1)
+		return false
+	}
+	if t.conf.queuePolicy == TrackerQueueBlock {
+		t.entries <- entry
+		return true
+	}
+	select {
+	case t.entries <- entry:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+	return true
+}
+
+// Dropped returns the number of entries lost because the queue was full
+func (t *Tracker) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// Reopen makes the tracker reopen the file, which was moved away by
+// an external tool like logrotate
+func (t *Tracker) Reopen() {
+	select {
+	case t.reopen <- struct{}{}:
+	default:
+	}
+}
+
+// Close waits for running calls of Save, writes out the queued entries
+// and closes the file
+func (t *Tracker) Close() {
+	t.closeMu.Lock()
+	t.closed = true
+	t.closeMu.Unlock()
+	done := make(chan struct{})
+	t.closing <- done
+	<-done
+}
+
+// writeEntry writes the entry as a JSON object with the configured
+// fields in the configured order
+func (t *Tracker) writeEntry(buf *bytes.Buffer, entry *trackerEntry) {
+	buf.WriteByte('{')
+	for i, field := range t.conf.fields {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		value, _ := json.Marshal(trackerFields[field](entry))
+		buf.WriteByte('"')
+		buf.WriteString(field)
+		buf.WriteString(`":`)
+		buf.Write(value)
 	}
+	buf.WriteString("}\n")
 }
 
 func (t *Tracker) Start() {
 	go func() {
 		log.Printf("Tracker is started")
 		buf := bytes.NewBuffer([]byte{})
-		ticker := time.Tick(time.Second * 30)
+		ticker := time.NewTicker(t.conf.flushInterval)
+		defer ticker.Stop()
 
 		for {
 			select {
-			case <-ticker:
-				_, err := buf.WriteTo(t.file)
-				if err != nil {
-					log.Printf("[Warning] Unable to write error to requests log")
-				}
-				buf.Reset()
+			case <-ticker.C:
+				t.flush(buf)
 			case entry := <-t.entries:
-				buf.WriteString(entry.date.UTC().Format("06-01-02 15:04:05 - "))
-				buf.WriteString(entry.domain)
-				buf.WriteString("\n")
-				if buf.Len() >= 2048 {
-					_, err := buf.WriteTo(t.file)
-					if err != nil {
-						log.Printf("[Warning] Unable to write error to requests log")
-					}
-					buf.Reset()
+				t.writeEntry(buf, entry)
+				if buf.Len() >= trackerBufferSize {
+					t.flush(buf)
+				}
+			case <-t.reopen:
+				t.flush(buf)
+				if t.file != nil {
+					t.file.Close()
+				}
+				if err := t.open(); err != nil {
+					log.Printf("[Warning] Unable to reopen requests log: %v", err)
+				}
+			case done := <-t.closing:
+				for len(t.entries) != 0 {
+					t.writeEntry(buf, <-t.entries)
+				}
+				t.flush(buf)
+				if t.file != nil {
+					t.file.Sync()
+					t.file.Close()
 				}
+				// Wait for compression of the last rotated file
+				t.cleanupMu.Lock()
+				t.cleanupMu.Unlock()
+				close(done)
+				return
 			}
 		}
 	}()
 }
+
+// flush writes the buffer out and rotates the file if it is due
+func (t *Tracker) flush(buf *bytes.Buffer) {
+	if t.file == nil {
+		// Reopening failed, try again
+		if err := t.open(); err != nil {
+			return
+		}
+	}
+	if buf.Len() != 0 {
+		n, err := buf.WriteTo(t.file)
+		t.size += n
+		if err != nil {
+			log.Printf("[Warning] Unable to write requests log: %v", err)
+		}
+		buf.Reset()
+	}
+	if (t.conf.maxSize != 0 && t.size >= t.conf.maxSize) ||
+		(t.conf.maxAge != 0 && t.size != 0 && time.Since(t.opened) >= t.conf.maxAge) {
+		t.rotate()
+	}
+}
+
+func (t *Tracker) rotate() {
+	t.file.Sync()
+	t.file.Close()
+	t.file = nil
+	rotated := t.conf.path + time.Now().Format(trackerRotatedSuffix)
+	if err := os.Rename(t.conf.path, rotated); err != nil {
+		log.Printf("[Warning] Unable to rotate requests log: %v", err)
+		rotated = ""
+	}
+	if err := t.open(); err != nil {
+		log.Printf("[Warning] Unable to reopen requests log: %v", err)
+	}
+	go t.cleanup(rotated)
+}
+
+// cleanup compresses the rotated file and removes the oldest ones
+func (t *Tracker) cleanup(rotated string) {
+	t.cleanupMu.Lock()
+	defer t.cleanupMu.Unlock()
+
+	if rotated != "" && t.conf.compress {
+		if err := compressFile(rotated); err != nil {
+			log.Printf("[Warning] Unable to compress %s: %v", rotated, err)
+		}
+	}
+	if t.conf.keep == 0 {
+		return
+	}
+	// The glob doesn't match the current file, as the suffix starts with "."
+	names, err := filepath.Glob(t.conf.path + ".[0-9]*")
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	for len(names) > t.conf.keep {
+		if err := os.Remove(names[0]); err != nil {
+			log.Printf("[Warning] Unable to remove %s: %v", names[0], err)
+		}
+		names = names[1:]
+	}
+}
+
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream selection policies
+const (
+	SelectorRandom        = "random"
+	SelectorRoundRobin    = "round_robin"
+	SelectorLowestLatency = "lowest_latency"
+	SelectorFailover      = "failover"
+)
+
+const (
+	// Weight of the latest sample in smoothed RTT and success rate
+	upstreamEWMAWeight = 0.2
+	// First ejection period, doubled after each failed probe
+	upstreamMinBackoff = 5 * time.Second
+	// Idle DNS-over-TLS connections kept per upstream
+	upstreamMaxIdleConns = 8
+)
+
+// Upstreams with this prefix are queried over DNS-over-TLS (RFC 7858)
+const tlsUpstreamPrefix = "tls://"
+
+type upstream struct {
+	address string
+	// Dial address and TLS parameters of DNS-over-TLS upstreams
+	tlsAddress string
+	tlsConfig  *tls.Config
+	idleConns  chan *dns.Conn
+
+	mu          sync.Mutex
+	srtt        time.Duration
+	successRate float64
+	failures    uint
+	ejected     bool
+	backoff     time.Duration
+}
+
+type upstreamExchangeFunc func(ctx context.Context, u *upstream, msg *dns.Msg) (*dns.Msg, time.Duration, error)
+
+// upstreamPool tracks health of upstream resolvers and picks one for
+// every try according to the configured policy. Upstreams that fail
+// maxFailures times in a row are ejected and probed in the background
+// with exponential backoff until they answer again.
+type upstreamPool struct {
+	upstreams   []*upstream
+	selector    string
+	maxFailures uint
+	maxBackoff  time.Duration
+	timeout     time.Duration
+	exchange    upstreamExchangeFunc
+	next        uint32
+	// Set when the pool is no longer used after a configuration reload
+	closed uint32
+}
+
+func newUpstreamPool(addresses []string, conf *config, exchange upstreamExchangeFunc) *upstreamPool {
+	p := &upstreamPool{
+		selector:    conf.UpstreamSelector,
+		maxFailures: conf.UpstreamMaxFailures,
+		maxBackoff:  time.Duration(conf.UpstreamMaxBackoff) * time.Second,
+		timeout:     time.Duration(conf.Timeout) * time.Second,
+		exchange:    exchange,
+	}
+	for _, address := range addresses {
+		// Addresses are already validated by loadConfig
+		u, _ := parseUpstream(address)
+		p.upstreams = append(p.upstreams, u)
+	}
+	return p
+}
+
+// key identifies pools with the same settings, which are reused
+// across configuration reloads
+func (p *upstreamPool) key() string {
+	addresses := make([]string, len(p.upstreams))
+	for i, u := range p.upstreams {
+		addresses[i] = u.address
+	}
+	return fmt.Sprintf("%q %s %d %v %v", addresses, p.selector, p.maxFailures, p.maxBackoff, p.timeout)
+}
+
+// close stops probing ejected upstreams and closes idle connections
+func (p *upstreamPool) close() {
+	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
+		return
+	}
+	for _, u := range p.upstreams {
+		for {
+			conn, _ := u.getConn()
+			if conn == nil {
+				break
+			}
+			conn.Close()
+		}
+	}
+}
+
+// parseUpstream accepts either a plain "host:port" address or a
+// DNS-over-TLS one in the form "tls://host[:port][#server-name]".
+// The server name defaults to the host if it is not an IP address.
+func parseUpstream(address string) (*upstream, error) {
+	u := &upstream{
+		address:     address,
+		successRate: 1,
+	}
+	if !strings.HasPrefix(address, tlsUpstreamPrefix) {
+		return u, nil
+	}
+
+	hostPort := strings.TrimPrefix(address, tlsUpstreamPrefix)
+	serverName := ""
+	if hash := strings.IndexByte(hostPort, '#'); hash >= 0 {
+		hostPort, serverName = hostPort[:hash], hostPort[hash+1:]
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = strings.Trim(hostPort, "[]"), "853"
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid upstream %q", address)
+	}
+	if serverName == "" {
+		if net.ParseIP(host) != nil {
+			return nil, fmt.Errorf("upstream %q needs a TLS server name, e.g. %s#dns.example.com", address, address)
+		}
+		serverName = host
+	}
+	u.tlsAddress = net.JoinHostPort(host, port)
+	u.tlsConfig = &tls.Config{
+		ServerName:         serverName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	u.idleConns = make(chan *dns.Conn, upstreamMaxIdleConns)
+	return u, nil
+}
+
+// pick returns an upstream which is not in tried, preferring healthy ones.
+// When every upstream has been tried already, the choice starts over.
+func (p *upstreamPool) pick(tried map[*upstream]bool) *upstream {
+	if len(tried) >= len(p.upstreams) {
+		for u := range tried {
+			delete(tried, u)
+		}
+	}
+
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !tried[u] && !u.isEjected() {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		// Everything is down, so try anything we haven't tried yet
+		for _, u := range p.upstreams {
+			if !tried[u] {
+				candidates = append(candidates, u)
+			}
+		}
+	}
+
+	switch p.selector {
+	case SelectorRoundRobin:
+		return candidates[int(atomic.AddUint32(&p.next, 1))%len(candidates)]
+	case SelectorLowestLatency:
+		best := candidates[0]
+		bestRTT := best.smoothedRTT()
+		for _, u := range candidates[1:] {
+			if rtt := u.smoothedRTT(); rtt < bestRTT {
+				best, bestRTT = u, rtt
+			}
+		}
+		return best
+	case SelectorFailover:
+		return candidates[0]
+	default:
+		return candidates[rand.Intn(len(candidates))]
+	}
+}
+
+func (p *upstreamPool) reportSuccess(u *upstream, rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addSample(rtt, true)
+	u.failures = 0
+}
+
+func (p *upstreamPool) reportFailure(u *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.addSample(p.timeout, false)
+	u.failures++
+	if u.ejected || p.maxFailures == 0 || u.failures < p.maxFailures {
+		return
+	}
+	u.ejected = true
+	u.backoff = upstreamMinBackoff
+	log.Printf("[Warning] Upstream %s is ejected after %d failures", u.address, u.failures)
+	time.AfterFunc(u.backoff, func() { p.probe(u) })
+}
+
+// probe checks an ejected upstream with a query for the root NS set
+func (p *upstreamPool) probe(u *upstream) {
+	if atomic.LoadUint32(&p.closed) != 0 {
+		return
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion(".", dns.TypeNS)
+	response, rtt, err := p.exchange(context.Background(), u, msg)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err == nil && !isFailureRcode(response.Rcode) {
+		u.addSample(rtt, true)
+		u.failures = 0
+		u.ejected = false
+		u.backoff = 0
+		log.Printf("Upstream %s is back after probing", u.address)
+		return
+	}
+	u.backoff *= 2
+	if p.maxBackoff != 0 && u.backoff > p.maxBackoff {
+		u.backoff = p.maxBackoff
+	}
+	time.AfterFunc(u.backoff, func() { p.probe(u) })
+}
+
+// isFailureRcode tells whether an answer with rcode counts as a failure
+// of the upstream. Such answers are only used if no other upstream
+// answers.
+func isFailureRcode(rcode int) bool {
+	return rcode == dns.RcodeServerFailure || rcode == dns.RcodeRefused
+}
+
+// Must be called with u.mu held
+func (u *upstream) addSample(rtt time.Duration, success bool) {
+	if u.srtt == 0 {
+		u.srtt = rtt
+	} else {
+		u.srtt = time.Duration((1-upstreamEWMAWeight)*float64(u.srtt) + upstreamEWMAWeight*float64(rtt))
+	}
+	sample := 0.
+	if success {
+		sample = 1
+	}
+	u.successRate = (1-upstreamEWMAWeight)*u.successRate + upstreamEWMAWeight*sample
+}
+
+func (u *upstream) isEjected() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ejected
+}
+
+// health returns the smoothed success rate of exchanges and whether
+// the upstream is ejected
+func (u *upstream) health() (successRate float64, ejected bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.successRate, u.ejected
+}
+
+func (u *upstream) smoothedRTT() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.srtt
+}
+
+// exchangeTLS sends the query over a reused or new DNS-over-TLS connection
+func (u *upstream) exchangeTLS(ctx context.Context, msg *dns.Msg, timeout time.Duration) (*dns.Msg, time.Duration, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		conn, reused := u.getConn()
+		if conn == nil {
+			var err error
+			conn, err = dns.DialTimeoutWithTLS("tcp", u.tlsAddress, u.tlsConfig, timeout)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		start := time.Now()
+		conn.SetDeadline(start.Add(timeout))
+		stop := cancelOnDone(ctx, conn)
+		err := conn.WriteMsg(msg)
+		var response *dns.Msg
+		if err == nil {
+			response, err = conn.ReadMsg()
+		}
+		if err == nil && response.Id != msg.Id {
+			err = dns.ErrId
+		}
+		stop()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			conn.Close()
+			return nil, 0, ctxErr
+		}
+		if err != nil {
+			conn.Close()
+			if reused {
+				// The server might have closed an idle connection
+				continue
+			}
+			return nil, 0, err
+		}
+		u.putConn(conn)
+		return response, time.Since(start), nil
+	}
+}
+
+// exchangeContext is like Client.Exchange, but gives up as soon as ctx
+// is done
+func exchangeContext(ctx context.Context, client *dns.Client, msg *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	conn, err := client.Dial(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if opt := msg.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	} else if opt == nil && client.UDPSize >= dns.MinMsgSize {
+		conn.UDPSize = client.UDPSize
+	}
+
+	start := time.Now()
+	conn.SetDeadline(start.Add(client.Timeout))
+	stop := cancelOnDone(ctx, conn)
+	defer stop()
+	err = conn.WriteMsg(msg)
+	var response *dns.Msg
+	if err == nil {
+		response, err = conn.ReadMsg()
+	}
+	if err == nil && response.Id != msg.Id {
+		err = dns.ErrId
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, 0, ctxErr
+	}
+	return response, time.Since(start), err
+}
+
+// cancelOnDone interrupts reads and writes of conn when ctx is done,
+// until stop is called
+func cancelOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
+
+func (u *upstream) getConn() (conn *dns.Conn, reused bool) {
+	select {
+	case conn = <-u.idleConns:
+		return conn, true
+	default:
+		return nil, false
+	}
+}
+
+func (u *upstream) putConn(conn *dns.Conn) {
+	select {
+	case u.idleConns <- conn:
+	default:
+		conn.Close()
+	}
+}
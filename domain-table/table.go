@@ -0,0 +1,201 @@
+// Package domainTable stores large domain lists in a compact, immutable
+// sorted string table.
+//
+// A map[string]bool costs roughly 50 bytes of overhead per entry on top of
+// the name. A Table keeps all names in one string with a 4 byte offset and
+// a flag byte per entry, and looks names up by binary search. Large tables
+// narrow the search down to the names sharing the first two bytes.
+package domainTable
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// The domain itself is listed
+	flagExact = 1 << iota
+	// The domain and all of its subdomains are listed
+	flagSubdomains
+)
+
+type entry struct {
+	name  string
+	flags uint8
+}
+
+// Builder collects domains for a Table
+type Builder struct {
+	entries []entry
+}
+
+// Add adds a lower-cased domain name. Subdomains selects whether the
+// subdomains of name are listed too.
+func (b *Builder) Add(name string, subdomains bool) {
+	var flags uint8 = flagExact
+	if subdomains {
+		flags = flagSubdomains
+	}
+	b.entries = append(b.entries, entry{strings.TrimSuffix(name, "."), flags})
+}
+
+// Build returns a Table with the added names and the number of
+// duplicates which were dropped. The Builder is empty afterwards.
+func (b *Builder) Build() (t *Table, duplicates int) {
+	entries := b.entries
+	b.entries = nil
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	size := 0
+	for _, e := range entries {
+		size += len(e.name)
+	}
+	var data strings.Builder
+	data.Grow(size)
+	t = &Table{
+		offsets: make([]uint32, 1, len(entries)+1),
+		flags:   make([]uint8, 0, len(entries)),
+	}
+	for i, e := range entries {
+		if i > 0 && e.name == entries[i-1].name {
+			last := len(t.flags) - 1
+			if t.flags[last]&e.flags != 0 {
+				duplicates++
+			} else {
+				t.size++
+			}
+			t.flags[last] |= e.flags
+			continue
+		}
+		data.WriteString(e.name)
+		t.offsets = append(t.offsets, uint32(data.Len()))
+		t.flags = append(t.flags, e.flags)
+		t.size++
+	}
+	t.data = data.String()
+	if len(t.flags) < len(entries) {
+		// Drop the capacity left over by merged names
+		t.offsets = append([]uint32(nil), t.offsets...)
+		t.flags = append([]uint8(nil), t.flags...)
+	}
+
+	if len(t.flags) < indexSize {
+		return t, duplicates
+	}
+	t.index = make([]uint32, indexSize+1)
+	for i := range t.flags {
+		t.index[prefix(t.name(i))+1]++
+	}
+	for p := 1; p <= indexSize; p++ {
+		t.index[p] += t.index[p-1]
+	}
+	return t, duplicates
+}
+
+// Table is an immutable set of domain rules. The zero value and a nil
+// Table are empty.
+type Table struct {
+	// Names sorted and concatenated without the trailing dot
+	data string
+	// Name i is data[offsets[i]:offsets[i+1]]
+	offsets []uint32
+	flags   []uint8
+	// Names with prefix p are index[p] up to index[p+1], nil for small
+	// tables
+	index []uint32
+	// Number of rules, a name listed both exactly and with its
+	// subdomains counts twice
+	size int
+}
+
+// Match looks up a lower-cased FQDN and returns the number of labels of
+// the most specific matching rule.
+func (t *Table) Match(fqdn string) (depth int, ok bool) {
+	_, depth, _, ok = t.match(fqdn)
+	return
+}
+
+// Rule returns the most specific rule matching a lower-cased FQDN, which
+// is name if subdomains is false and name with its subdomains otherwise.
+func (t *Table) Rule(fqdn string) (name string, subdomains bool, ok bool) {
+	name, _, subdomains, ok = t.match(fqdn)
+	return
+}
+
+func (t *Table) match(fqdn string) (rule string, depth int, subdomains bool, ok bool) {
+	if t == nil || len(t.flags) == 0 {
+		return "", 0, false, false
+	}
+	name := strings.TrimSuffix(fqdn, ".")
+	labels := 0
+	if name != "" {
+		labels = strings.Count(name, ".") + 1
+	}
+	for suffix := name; ; labels-- {
+		flags := t.lookup(suffix)
+		if flags&flagExact != 0 && suffix == name {
+			return suffix, labels, false, true
+		}
+		if flags&flagSubdomains != 0 {
+			return suffix, labels, true, true
+		}
+		if suffix == "" {
+			return "", 0, false, false
+		}
+		if dot := strings.IndexByte(suffix, '.'); dot >= 0 {
+			suffix = suffix[dot+1:]
+		} else {
+			suffix = ""
+		}
+	}
+}
+
+// lookup returns the flags of name, or 0 if it is not listed
+func (t *Table) lookup(name string) uint8 {
+	low, high := 0, len(t.flags)
+	if t.index != nil {
+		p := prefix(name)
+		low, high = int(t.index[p]), int(t.index[p+1])
+	}
+	for low < high {
+		middle := int(uint(low+high) >> 1)
+		if t.name(middle) < name {
+			low = middle + 1
+		} else {
+			high = middle
+		}
+	}
+	if low < len(t.flags) && t.name(low) == name {
+		return t.flags[low]
+	}
+	return 0
+}
+
+// Number of prefixes, which is also the smallest table with an index
+const indexSize = 1 << 16
+
+// prefix returns the first two bytes of name, which preserves the
+// sorting order of names
+func prefix(name string) int {
+	switch len(name) {
+	case 0:
+		return 0
+	case 1:
+		return int(name[0]) << 8
+	}
+	return int(name[0])<<8 | int(name[1])
+}
+
+func (t *Table) name(i int) string {
+	return t.data[t.offsets[i]:t.offsets[i+1]]
+}
+
+// Len returns the number of rules
+func (t *Table) Len() int {
+	if t == nil {
+		return 0
+	}
+	return t.size
+}
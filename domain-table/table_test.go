@@ -0,0 +1,240 @@
+package domainTable
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// ruleFlags is the reference for Table, the flags of every listed name
+type ruleFlags map[string]uint8
+
+// match looks up fqdn in the rules like Table.Match
+func (rules ruleFlags) match(fqdn string) (depth int, ok bool) {
+	name := strings.TrimSuffix(fqdn, ".")
+	labels := strings.Split(name, ".")
+	for i := range labels {
+		suffix := strings.Join(labels[i:], ".")
+		flags := rules[suffix]
+		if (flags&flagExact != 0 && i == 0) || flags&flagSubdomains != 0 {
+			return len(labels) - i, true
+		}
+	}
+	return 0, false
+}
+
+func TestTableMatch(t *testing.T) {
+	builder := &Builder{}
+	builder.Add("example.com", false)
+	builder.Add("ads.example.com", true)
+	builder.Add("tracker.net.", true)
+	builder.Add("tracker.net", false)
+	builder.Add("tracker.net", true)
+	builder.Add("a.b.c.org", false)
+	table, duplicates := builder.Build()
+	if duplicates != 1 {
+		t.Errorf("got %d duplicates, want 1", duplicates)
+	}
+	if table.Len() != 5 {
+		t.Errorf("got %d rules, want 5", table.Len())
+	}
+
+	tests := []struct {
+		fqdn  string
+		depth int
+		ok    bool
+	}{
+		{"example.com.", 2, true},
+		{"www.example.com.", 0, false},
+		{"com.", 0, false},
+		{"ads.example.com.", 3, true},
+		{"x.ads.example.com.", 3, true},
+		{"xads.example.com.", 0, false},
+		{"tracker.net.", 2, true},
+		{"a.b.tracker.net.", 2, true},
+		{"a.b.c.org.", 4, true},
+		{"b.c.org.", 0, false},
+		{"x.a.b.c.org.", 0, false},
+		{".", 0, false},
+	}
+	for _, test := range tests {
+		depth, ok := table.Match(test.fqdn)
+		if depth != test.depth || ok != test.ok {
+			t.Errorf("Match(%q) = %d, %v, want %d, %v", test.fqdn, depth, ok, test.depth, test.ok)
+		}
+	}
+
+	var empty *Table
+	if _, ok := empty.Match("example.com."); ok || empty.Len() != 0 {
+		t.Error("nil table isn't empty")
+	}
+}
+
+// TestTableMatchGenerated compares lookups with a map, for tables below
+// and above indexSize
+func TestTableMatchGenerated(t *testing.T) {
+	for _, size := range []int{1000, 2 * indexSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(int64(size)))
+			rules := ruleFlags{}
+			builder := &Builder{}
+			var names []string
+			for i := 0; i < size; i++ {
+				name := randomName(rnd)
+				if i > 0 && rnd.Intn(10) == 0 {
+					// Duplicates and names listed both ways
+					name = names[rnd.Intn(len(names))]
+				}
+				subdomains := rnd.Intn(2) == 0
+				builder.Add(name, subdomains)
+				if subdomains {
+					rules[name] |= flagSubdomains
+				} else {
+					rules[name] |= flagExact
+				}
+				names = append(names, name)
+			}
+			table, _ := builder.Build()
+			if (table.index != nil) != (len(rules) >= indexSize) {
+				t.Fatalf("table of %d names has index %v", len(rules), table.index != nil)
+			}
+
+			queries := []string{".", "com.", "co.uk."}
+			for i := 0; i < 5000; i++ {
+				name := names[rnd.Intn(len(names))]
+				queries = append(queries, name+".", "cdn."+name+".", randomName(rnd)+".", name[1:]+".")
+			}
+			for _, query := range queries {
+				depth, ok := table.Match(query)
+				wantDepth, wantOK := rules.match(query)
+				if depth != wantDepth || ok != wantOK {
+					t.Errorf("Match(%q) = %d, %v, want %d, %v", query, depth, ok, wantDepth, wantOK)
+				}
+			}
+		})
+	}
+}
+
+// Sizes of the generated lists, like large blocklists
+var benchmarkSizes = []int{1000000, 10000000}
+
+// Top-level domains of the generated names, weighted by repetition
+var benchmarkTLDs = []string{"com", "com", "com", "com", "net", "org", "ru", "de", "io", "co.uk"}
+
+var benchmarkNames []string
+
+// generatedNames returns size names for the benchmark lists and queries
+// for listed names, their subdomains and unlisted names
+func generatedNames(size int) (names []string, queries []string) {
+	if len(benchmarkNames) < size {
+		rnd := rand.New(rand.NewSource(1))
+		benchmarkNames = make([]string, size)
+		for i := range benchmarkNames {
+			benchmarkNames[i] = randomName(rnd)
+		}
+	}
+	names = benchmarkNames[:size]
+	rnd := rand.New(rand.NewSource(2))
+	queries = make([]string, 0, 3000)
+	for i := 0; i < 1000; i++ {
+		name := names[rnd.Intn(len(names))]
+		queries = append(queries, name+".", "cdn."+name+".", randomName(rnd)+".")
+	}
+	return names, queries
+}
+
+func randomName(rnd *rand.Rand) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	label := make([]byte, 6+rnd.Intn(10))
+	for i := range label {
+		label[i] = letters[rnd.Intn(len(letters))]
+	}
+	name := string(label) + "." + benchmarkTLDs[rnd.Intn(len(benchmarkTLDs))]
+	if rnd.Intn(4) == 0 {
+		name = "www." + name
+	}
+	return name
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+func buildTable(names []string) *Table {
+	builder := &Builder{}
+	for i, name := range names {
+		builder.Add(name, i%2 == 0)
+	}
+	table, _ := builder.Build()
+	return table
+}
+
+// runSizes runs the benchmark for every size of benchmarkSizes
+func runSizes(b *testing.B, benchmark func(b *testing.B, size int)) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("%dM", size/1000000), func(b *testing.B) {
+			benchmark(b, size)
+		})
+	}
+}
+
+func BenchmarkTableBuild(b *testing.B) {
+	runSizes(b, func(b *testing.B, size int) {
+		names, _ := generatedNames(size)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			buildTable(names)
+		}
+	})
+}
+
+// BenchmarkTableMatch also reports the memory of the table as MB
+func BenchmarkTableMatch(b *testing.B) {
+	runSizes(b, func(b *testing.B, size int) {
+		names, queries := generatedNames(size)
+		before := heapInUse()
+		table := buildTable(names)
+		memory := heapInUse() - before
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			table.Match(queries[i%len(queries)])
+		}
+		b.ReportMetric(float64(memory)/(1<<20), "MB")
+	})
+}
+
+// BenchmarkMapMatch measures a map[string]bool with the same names for
+// comparison
+func BenchmarkMapMatch(b *testing.B) {
+	runSizes(b, func(b *testing.B, size int) {
+		names, queries := generatedNames(size)
+		before := heapInUse()
+		set := make(map[string]bool, len(names))
+		for _, name := range names {
+			set[name+"."] = true
+		}
+		memory := heapInUse() - before
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// Check the name and its parents, like Table.Match does
+			for name := queries[i%len(queries)]; name != ""; {
+				if set[name] {
+					break
+				}
+				dot := strings.IndexByte(name, '.')
+				if dot < 0 {
+					break
+				}
+				name = name[dot+1:]
+			}
+		}
+		b.ReportMetric(float64(memory)/(1<<20), "MB")
+	})
+}